@@ -0,0 +1,492 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sd-bot/metrics"
+	"github.com/sztanpet/sd-bot/services"
+	"github.com/sztanpet/sirc"
+	"golang.org/x/net/context"
+)
+
+type cacheEntry struct {
+	nick    string // as the server sent it, the key is folded
+	account string
+	expires time.Time // zero if the entries never expire
+}
+
+// nickFolder folds the nicks with the rfc1459 casemapping, the default of the
+// networks, []\~ are the uppercase of {}|^, the servers answer with the case
+// the user picked, not the one we asked with
+var nickFolder = strings.NewReplacer("[", "{", "]", "}", "\\", "|", "~", "^")
+
+func foldNick(nick string) string {
+	return nickFolder.Replace(strings.ToLower(nick))
+}
+
+// adminCache maps nicks to accounts, a nick stays in it as long as it is in a
+// channel with the bot and the entry has not expired, the nicks are folded
+type adminCache struct {
+	mu       sync.Mutex
+	m        map[string]cacheEntry
+	channels map[string]map[string]struct{} // nick -> the channels shared with it
+	ttl      time.Duration
+	me       string // the nick of the bot
+}
+
+// init sets how long entries are valid, and resets the cache
+func (ac *adminCache) init(ttl time.Duration) {
+	ac.mu.Lock()
+	ac.ttl = ttl
+	ac.mu.Unlock()
+	ac.reset()
+}
+
+// reset clears the cache, the owners are resolved like everybody else, a
+// nick being the same as the account of an owner means nothing
+func (ac *adminCache) reset() {
+	ac.mu.Lock()
+	ac.m = map[string]cacheEntry{}
+	ac.channels = map[string]map[string]struct{}{}
+	ac.mu.Unlock()
+}
+func (ac *adminCache) Add(nick, user string) {
+	ac.mu.Lock()
+	e := cacheEntry{nick: nick, account: user}
+	if ac.ttl > 0 {
+		e.expires = time.Now().Add(ac.ttl)
+	}
+	ac.m[foldNick(nick)] = e
+	ac.mu.Unlock()
+}
+
+// AddShared is Add for the nicks that share a channel with the bot, the
+// others are not cached, their PART, QUIT and NICK would never be seen, so a
+// new user of the nick would inherit the account
+func (ac *adminCache) AddShared(nick, user string) {
+	ac.mu.Lock()
+	_, shared := ac.channels[foldNick(nick)]
+	ac.mu.Unlock()
+	if shared {
+		ac.Add(nick, user)
+	}
+}
+func (ac *adminCache) Del(nick string) {
+	ac.mu.Lock()
+	delete(ac.m, foldNick(nick))
+	ac.mu.Unlock()
+}
+func (ac *adminCache) Get(nick string) (string, bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	nick = foldNick(nick)
+	e, ok := ac.m[nick]
+	if ok && !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(ac.m, nick)
+		return "", false
+	}
+	return e.account, ok
+}
+
+// Accounts returns a copy of the valid nick -> account mappings
+func (ac *adminCache) Accounts() map[string]string {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	now := time.Now()
+	ret := make(map[string]string, len(ac.m))
+	for _, e := range ac.m {
+		if e.expires.IsZero() || now.Before(e.expires) {
+			ret[e.nick] = e.account
+		}
+	}
+	return ret
+}
+
+// SetMe records the nick of the bot, its own joins and parts are special
+func (ac *adminCache) SetMe(nick string) {
+	ac.mu.Lock()
+	ac.me = nick
+	ac.mu.Unlock()
+}
+
+// IsMe returns whether the nick is the nick of the bot
+func (ac *adminCache) IsMe(nick string) bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.isMe(nick)
+}
+
+// the lock needs to be held by the caller
+func (ac *adminCache) isMe(nick string) bool {
+	return foldNick(nick) == foldNick(ac.me)
+}
+
+// Joined records that the nick is in the channel
+func (ac *adminCache) Joined(nick, channel string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.isMe(nick) {
+		return
+	}
+
+	nick = foldNick(nick)
+	chans, ok := ac.channels[nick]
+	if !ok {
+		chans = map[string]struct{}{}
+		ac.channels[nick] = chans
+	}
+	chans[strings.ToLower(channel)] = struct{}{}
+}
+
+// Parted records that the nick left the channel (or got kicked), if the bot
+// left, every nick forgets the channel, nicks that do not share a channel
+// with the bot anymore are evicted, because we would not notice if they
+// changed nicks or logged out
+func (ac *adminCache) Parted(nick, channel string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	channel = strings.ToLower(channel)
+
+	if !ac.isMe(nick) {
+		ac.leave(foldNick(nick), channel)
+		return
+	}
+
+	for n := range ac.channels {
+		ac.leave(n, channel)
+	}
+}
+
+// the lock needs to be held by the caller, the nick has to be folded
+func (ac *adminCache) leave(nick, channel string) {
+	chans := ac.channels[nick]
+	delete(chans, channel)
+	if len(chans) == 0 {
+		delete(ac.channels, nick)
+		delete(ac.m, nick)
+	}
+}
+
+// Quit forgets everything about the nick
+func (ac *adminCache) Quit(nick string) {
+	ac.mu.Lock()
+	nick = foldNick(nick)
+	delete(ac.channels, nick)
+	delete(ac.m, nick)
+	ac.mu.Unlock()
+}
+
+// Rename moves everything known about the nick to the new nick
+func (ac *adminCache) Rename(nick, newnick string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.isMe(nick) {
+		ac.me = newnick
+		return
+	}
+
+	nick, folded := foldNick(nick), foldNick(newnick)
+	if e, ok := ac.m[nick]; ok {
+		delete(ac.m, nick)
+		e.nick = newnick
+		ac.m[folded] = e
+	}
+	if chans, ok := ac.channels[nick]; ok {
+		delete(ac.channels, nick)
+		ac.channels[folded] = chans
+	}
+}
+
+type lookupResult struct {
+	account string
+	ok      bool
+}
+
+// accountLookups resolves nicks to accounts with WHOIS, every nick is only
+// looked up once no matter how many are waiting for it, and the nicks that
+// turned out not to be identified are remembered for a while, the nicks are
+// folded
+type accountLookups struct {
+	mu       sync.Mutex
+	pending  map[string][]chan lookupResult
+	negative map[string]time.Time // nick -> when the negative answer expires
+	// sends the WHOIS, c.Write if nil
+	write func(c *sirc.IConn, m *irc.Message)
+}
+
+const (
+	// how long to wait for an answer to a WHOIS
+	lookupTimeout = 30 * time.Second
+	// how long to remember that a nick is not identified
+	negativeTTL = time.Minute
+)
+
+func (l *accountLookups) reset() {
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = map[string][]chan lookupResult{}
+	l.negative = map[string]time.Time{}
+	l.mu.Unlock()
+
+	// nothing is going to answer the requests sent before, let the waiters go
+	for _, waiters := range pending {
+		for _, ch := range waiters {
+			ch <- lookupResult{}
+		}
+	}
+}
+
+// Lookup returns the account of the nick, asking the server if it is not
+// known yet, ok is false if the nick is not identified or ctx expired
+func (l *accountLookups) Lookup(ctx context.Context, c *sirc.IConn, nick string) (string, bool) {
+	if account, ok := ac.Get(nick); ok {
+		return account, true
+	}
+
+	// buffered, so that resolve never blocks, every waiter gets exactly one
+	// result because resolve removes them all at once
+	ch := make(chan lookupResult, 1)
+	key := foldNick(nick)
+
+	l.mu.Lock()
+	if t, ok := l.negative[key]; ok && time.Now().Before(t) {
+		l.mu.Unlock()
+		return "", false
+	}
+	delete(l.negative, key)
+
+	waiters := l.pending[key]
+	l.pending[key] = append(waiters, ch)
+	write := l.write
+	l.mu.Unlock()
+
+	if len(waiters) == 0 { // nobody asked yet
+		m := &irc.Message{
+			Command: irc.WHOIS,
+			Params:  []string{nick, nick},
+		}
+		if write != nil {
+			write(c, m)
+		} else {
+			c.Write(m)
+		}
+	}
+
+	start := time.Now()
+	select {
+	case r := <-ch:
+		result := "notfound"
+		if r.ok {
+			result = "found"
+		}
+		lookupDuration.Since(start, result)
+		return r.account, r.ok
+	case <-ctx.Done():
+		l.cancel(key, ch)
+		lookupTimeouts.Inc()
+		return "", false
+	}
+}
+
+// cancel removes the waiter of a lookup that timed out, the nick is folded
+func (l *accountLookups) cancel(nick string, ch chan lookupResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	waiters := l.pending[nick]
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(l.pending, nick)
+	} else {
+		l.pending[nick] = waiters
+	}
+}
+
+// resolve answers everyone waiting for the nick, the answer is only cached if
+// someone was waiting for it, because RPL_ENDOFWHOIS follows every WHOIS
+// including the successful ones, and if the nick shares a channel with the bot
+func (l *accountLookups) resolve(nick, account string, ok bool) {
+	key := foldNick(nick)
+	l.mu.Lock()
+	waiters, pending := l.pending[key]
+	delete(l.pending, key)
+	if pending && ok {
+		// while still holding the lock, so that a new lookup either finds it
+		// in the cache or joins the waiters
+		ac.AddShared(nick, account)
+	} else if pending {
+		l.negative[key] = time.Now().Add(negativeTTL)
+	}
+	l.mu.Unlock()
+
+	if !pending {
+		return
+	}
+
+	r := lookupResult{account: account, ok: ok}
+	for _, ch := range waiters {
+		ch <- r
+	}
+}
+
+// forget drops the negative answer about the nick, because it changed or
+// identified since
+func (l *accountLookups) forget(nick string) {
+	l.mu.Lock()
+	delete(l.negative, foldNick(nick))
+	l.mu.Unlock()
+}
+
+// Nicks returns the folded nicks that are waiting for an answer
+func (l *accountLookups) Nicks() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := make([]string, 0, len(l.pending))
+	for nick := range l.pending {
+		ret = append(ret, nick)
+	}
+	return ret
+}
+
+var (
+	ac      = &adminCache{}
+	lookups = &accountLookups{}
+
+	lookupDuration = metrics.NewHistogram("sdbot_account_lookup_duration_seconds",
+		"How long resolving the account of a nick took, by result (found or notfound).",
+		metrics.DefaultBuckets, "result")
+	lookupTimeouts = metrics.NewCounter("sdbot_account_lookup_timeouts_total",
+		"The number of account lookups that timed out.")
+	// the services of the network, set from the config by initIRC
+	svc services.Services
+)
+
+func init() {
+	ac.reset()
+	lookups.reset()
+}
+
+// membershipCommands are the commands trackMembership needs to see
+var membershipCommands = []string{
+	irc.JOIN, irc.RPL_NAMREPLY, irc.KICK, irc.PART, irc.QUIT, irc.NICK, "DISCONNECT",
+}
+
+// trackMembership keeps the admin cache and the pending lookups in sync with
+// who is where and under which nick, it never consumes the message
+func trackMembership(c *sirc.IConn, m *irc.Message, tags map[string]string) {
+	switch m.Command {
+	case irc.JOIN:
+		// >> :nick!user@host JOIN #channel
+		if m.Prefix == nil {
+			return
+		}
+		channel := m.Trailing
+		if len(m.Params) > 0 {
+			channel = m.Params[0]
+		}
+		ac.Joined(m.Prefix.Name, channel)
+	case irc.RPL_NAMREPLY:
+		// >> :server 353 sd-bot = #systemd :sd-bot @sztanpet +armin
+		if len(m.Params) < 3 {
+			return
+		}
+		for _, nick := range strings.Fields(m.Trailing) {
+			ac.Joined(strings.TrimLeft(nick, "~&@%+"), m.Params[2])
+		}
+	case irc.KICK:
+		// >> :op!user@host KICK #channel nick :reason
+		if len(m.Params) > 1 {
+			ac.Parted(m.Params[1], m.Params[0])
+		}
+	case irc.PART: // invalidate cache if no channel is shared anymore
+		// >> :nick!user@host PART #channel :reason
+		if m.Prefix == nil {
+			return
+		}
+		channel := m.Trailing
+		if len(m.Params) > 0 {
+			channel = m.Params[0]
+		}
+		ac.Parted(m.Prefix.Name, channel)
+	case irc.QUIT:
+		if m.Prefix == nil {
+			return
+		}
+		ac.Quit(m.Prefix.Name)
+		lookups.forget(m.Prefix.Name)
+	case "DISCONNECT":
+		ac.reset() // clear the entire cache
+		lookups.reset()
+	case irc.NICK:
+		if m.Prefix == nil {
+			return
+		}
+		ac.Rename(m.Prefix.Name, m.Trailing)
+		lookups.forget(m.Prefix.Name)
+		lookups.forget(m.Trailing)
+	}
+}
+
+// servicesCommands are the commands handleServices needs to see
+var servicesCommands = []string{
+	"330", "307", irc.RPL_ENDOFWHOIS, irc.ERR_NOSUCHNICK, "263", irc.NOTICE,
+}
+
+// handleServices resolves the pending account lookups from the whois replies
+// and the answers of the services, it consumes only those
+func handleServices(c *sirc.IConn, m *irc.Message, tags map[string]string) bool {
+	switch m.Command {
+	case "330": // whois success
+		// << whois armin armin
+		// >> :wilhelm.freenode.net 330 sztanpet ariscop Phase4 :is logged in as
+		if len(m.Params) > 2 {
+			lookups.resolve(m.Params[1], m.Params[2], true)
+		}
+	case "307": // whois, identified for the nick, on networks without 330
+		// >> :irc.oftc.net 307 sd-bot armin :user has identified to services
+		if svc.TrustRegNick() && len(m.Params) > 1 {
+			lookups.resolve(m.Params[1], m.Params[1], true)
+		}
+	case irc.RPL_ENDOFWHOIS: // no 330 before it, not identified
+		// >> :wilhelm.freenode.net 318 sd-bot armin :End of /WHOIS list.
+		fallthrough
+	case irc.ERR_NOSUCHNICK:
+		// >> :wilhelm.freenode.net 401 sd-bot armin :No such nick/channel
+		if len(m.Params) > 1 {
+			lookups.resolve(m.Params[1], "", false)
+		}
+	case "263": // whois failed, ask for info from nickserv instead
+		// << whois wolfe wolfe
+		// >> :wolfe.freenode.net 263 sztanpet WHOIS :This command could not be completed because it has been used recently, and is rate-limited.
+		// the reply does not say who we asked about, so ask about everyone
+		// we are waiting for
+		for _, nick := range lookups.Nicks() {
+			if im := svc.Info(nick); im != nil {
+				c.Write(im)
+			}
+		}
+	case irc.NOTICE: // asked for info from nickserv, it arrived
+		// << PRIVMSG NickServer :info armin
+		// >> :NickServ!NickServ@services. NOTICE sztanpet :Information on armin (account armin):
+		// every other notice is left for the rest of the bot
+		nick, account, ok := svc.ParseInfo(m)
+		if !ok {
+			return false
+		}
+
+		lookups.resolve(nick, account, true)
+	default:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,203 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sirc"
+	"golang.org/x/net/context"
+)
+
+// testLookups resets the cache and the lookups, and returns a function that
+// returns the nicks a WHOIS was sent for
+func testLookups(t *testing.T, ttl time.Duration) func() []string {
+	var mu sync.Mutex
+	var sent []string
+	ac.init(ttl)
+	lookups.reset()
+	lookups.write = func(c *sirc.IConn, m *irc.Message) {
+		mu.Lock()
+		sent = append(sent, m.Params[0])
+		mu.Unlock()
+	}
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), sent...)
+	}
+}
+
+// waitPending waits until n lookups wait for the nick
+func waitPending(t *testing.T, nick string, n int) {
+	for i := 0; i < 100; i++ {
+		lookups.mu.Lock()
+		waiting := len(lookups.pending[foldNick(nick)])
+		lookups.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d lookups waiting for %s", n, nick)
+}
+
+func TestFoldNick(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"Lennart", "lennart", true},
+		{"[kay]", "{KAY}", true},
+		{`ab\~`, "AB|^", true},
+		{"armin", "armin_", false},
+	}
+	for _, tt := range tests {
+		if same := foldNick(tt.a) == foldNick(tt.b); same != tt.same {
+			t.Errorf("%s %s: expected same %v", tt.a, tt.b, tt.same)
+		}
+	}
+}
+
+func TestConcurrentLookups(t *testing.T) {
+	sent := testLookups(t, 0)
+	ac.Joined("Lennart", "#systemd")
+
+	const n = 5
+	var wg sync.WaitGroup
+	results := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go (func() {
+			defer wg.Done()
+			account, _ := lookups.Lookup(context.Background(), nil, "Lennart")
+			results <- account
+		})()
+	}
+
+	waitPending(t, "lennart", n)
+	// the reply has the case the user picked
+	lookups.resolve("lennart", "mezcalero", true)
+	wg.Wait()
+	close(results)
+
+	for account := range results {
+		if account != "mezcalero" {
+			t.Errorf("unexpected account %q", account)
+		}
+	}
+	if s := sent(); len(s) != 1 {
+		t.Fatalf("expected a single WHOIS, got %v", s)
+	}
+
+	// cached now, no more WHOIS
+	if account, ok := lookups.Lookup(context.Background(), nil, "LENNART"); !ok || account != "mezcalero" {
+		t.Fatalf("unexpected account %q", account)
+	}
+	if s := sent(); len(s) != 1 {
+		t.Fatalf("expected a single WHOIS, got %v", s)
+	}
+}
+
+func TestNegativeLookup(t *testing.T) {
+	sent := testLookups(t, 0)
+
+	done := make(chan bool)
+	go (func() {
+		_, ok := lookups.Lookup(context.Background(), nil, "Kay")
+		done <- ok
+	})()
+	waitPending(t, "kay", 1)
+	lookups.resolve("KAY", "", false)
+	if <-done {
+		t.Fatal("expected the lookup to fail")
+	}
+
+	// remembered, not asked again
+	if _, ok := lookups.Lookup(context.Background(), nil, "kay"); ok || len(sent()) != 1 {
+		t.Fatalf("expected the negative answer from the cache, sent %v", sent())
+	}
+
+	// identified since, asked again
+	lookups.forget("Kay")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, ok := lookups.Lookup(ctx, nil, "kay"); ok || len(sent()) != 2 {
+		t.Fatalf("expected a new WHOIS that times out, sent %v", sent())
+	}
+	if len(lookups.Nicks()) != 0 {
+		t.Fatalf("the timed out lookup is still pending: %v", lookups.Nicks())
+	}
+}
+
+func TestLookupWithoutChannel(t *testing.T) {
+	sent := testLookups(t, 0)
+
+	// like a private message from someone not in a channel with the bot
+	for i := 1; i <= 2; i++ {
+		done := make(chan string)
+		go (func() {
+			account, _ := lookups.Lookup(context.Background(), nil, "Armin")
+			done <- account
+		})()
+		waitPending(t, "armin", 1)
+		lookups.resolve("Armin", "armin", true)
+		if account := <-done; account != "armin" {
+			t.Fatalf("unexpected account %q", account)
+		}
+
+		// nothing would evict it, so it is asked for every time
+		if _, ok := ac.Get("armin"); ok || len(sent()) != i {
+			t.Fatalf("expected it not to be cached, sent %v", sent())
+		}
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	testLookups(t, 20*time.Millisecond)
+
+	ac.Add("Armin", "armin")
+	tests := []struct {
+		nick    string
+		wait    time.Duration
+		account string
+		ok      bool
+	}{
+		{"armin", 0, "armin", true},
+		{"ARMIN", 0, "armin", true},
+		{"armin", 30 * time.Millisecond, "", false},
+	}
+	for _, tt := range tests {
+		time.Sleep(tt.wait)
+		if account, ok := ac.Get(tt.nick); account != tt.account || ok != tt.ok {
+			t.Errorf("%s after %v: unexpected %q %v", tt.nick, tt.wait, account, ok)
+		}
+	}
+
+	// the nick of the accounts is the one the server sent
+	ac.Add("Armin", "armin")
+	if accounts := ac.Accounts(); accounts["Armin"] != "armin" {
+		t.Errorf("unexpected accounts %v", accounts)
+	}
+}
@@ -0,0 +1,225 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package audit keeps an append-only log of the administrative actions
+package audit
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sztanpet/sd-bot/config"
+	"github.com/sztanpet/sd-bot/debug"
+	"github.com/sztanpet/sd-bot/web"
+	"golang.org/x/net/context"
+)
+
+// the number of entries kept in memory for .audit and the web view
+const keepRecent = 100
+
+// Entry is a single administrative action
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Nick    string    `json:"nick"`
+	Account string    `json:"account"`
+	Channel string    `json:"channel"`
+	// the address of the client for the actions on the website
+	Remote  string `json:"remote,omitempty"`
+	Command string `json:"command"`
+	Args    string `json:"args"`
+	// "denied" if the sender was not allowed to run the command, the outcome
+	// of the command otherwise, like "ok" or "not found"
+	Result string `json:"result"`
+}
+
+var (
+	mu     sync.Mutex
+	cfg    config.Audit
+	f      *os.File
+	size   int64
+	recent []Entry
+	tpl    *template.Template
+)
+
+func Init(ctx context.Context) context.Context {
+	cfg = config.FromContext(ctx).Audit
+
+	if cfg.Logfile != "" {
+		loadRecent()
+		if err := open(); err != nil {
+			d.F("Could not open the audit log, err: %v", err)
+		}
+	}
+
+	if cfg.HookPath != "" && cfg.Password != "" {
+		tpl = template.Must(template.ParseFiles(cfg.TplPath))
+		web.Admin.HandleFunc(cfg.HookPath, handler)
+	}
+
+	return ctx
+}
+
+// loadRecent reads the last entries of the current logfile back into memory
+func loadRecent() {
+	rf, err := os.Open(cfg.Logfile)
+	if err != nil {
+		return
+	}
+	defer rf.Close()
+
+	s := bufio.NewScanner(rf)
+	for s.Scan() {
+		var e Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			continue
+		}
+		remember(e)
+	}
+}
+
+func open() (err error) {
+	f, err = os.OpenFile(cfg.Logfile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	size = info.Size()
+	return
+}
+
+// remember keeps the entry in memory, the lock needs to be held by the caller
+func remember(e Entry) {
+	recent = append(recent, e)
+	if l := len(recent); l > keepRecent {
+		recent = append(recent[:0], recent[l-keepRecent:]...)
+	}
+}
+
+// Log records the entry, the time is filled in automatically
+func Log(e Entry) {
+	e.Time = time.Now()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	remember(e)
+	if f == nil {
+		return
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		d.Error("Could not marshal audit entry", "entry", e, "err", err)
+		return
+	}
+
+	b = append(b, '\n')
+	n, err := f.Write(b)
+	size += int64(n)
+	if err != nil {
+		d.Error("Could not write audit entry", "entry", e, "err", err)
+	}
+
+	if cfg.MaxSize > 0 && size >= cfg.MaxSize {
+		if err := rotate(); err != nil {
+			d.Error("Could not rotate the audit log", "err", err)
+		}
+	}
+}
+
+// rotate moves logfile to logfile.1, logfile.1 to logfile.2 and so on, keeping
+// at most cfg.Keep rotated files, the lock needs to be held by the caller
+func rotate() error {
+	_ = f.Close()
+	f = nil
+
+	if cfg.Keep > 0 {
+		base := cfg.Logfile + "."
+		for i := cfg.Keep - 1; i >= 1; i-- {
+			_ = os.Rename(base+strconv.Itoa(i), base+strconv.Itoa(i+1))
+		}
+		if err := os.Rename(cfg.Logfile, base+"1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(cfg.Logfile); err != nil {
+		return err
+	}
+
+	return open()
+}
+
+// Recent returns at most the n last entries, oldest first
+func Recent(n int) []Entry {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if n > len(recent) {
+		n = len(recent)
+	}
+
+	ret := make([]Entry, n)
+	copy(ret, recent[len(recent)-n:])
+	return ret
+}
+
+// String formats the entry for irc
+func (e Entry) String() string {
+	ret := e.Time.Format("2006-01-02 15:04:05") + " " + e.Nick + " (" + e.Account + ")"
+	if e.Channel != "" {
+		ret += " " + e.Channel
+	}
+	if e.Remote != "" {
+		ret += " " + e.Remote
+	}
+	ret += " ." + e.Command
+	if e.Args != "" {
+		ret += " " + e.Args
+	}
+	return ret + " -> " + e.Result
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	_, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(cfg.Password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="sd-bot audit log"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	entries := Recent(keepRecent)
+	// newest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	if err := tpl.ExecuteTemplate(w, "audit.tpl", entries); err != nil {
+		d.Error("Could not render the audit log", "err", err)
+	}
+}
@@ -0,0 +1,70 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package audit
+
+import (
+	"os"
+	"testing"
+
+	"github.com/sztanpet/sd-bot/config"
+)
+
+const testFileName = "testaudit.tmp"
+
+func TestRotate(t *testing.T) {
+	defer func() {
+		_ = f.Close()
+		os.Remove(testFileName)
+		os.Remove(testFileName + ".1")
+		os.Remove(testFileName + ".2")
+	}()
+
+	cfg = config.Audit{
+		Logfile: testFileName,
+		MaxSize: 1,
+		Keep:    1,
+	}
+	if err := open(); err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	Log(Entry{Nick: "first", Command: "raw"})
+	Log(Entry{Nick: "second", Command: "raw"})
+	if _, err := os.Stat(testFileName + ".1"); err != nil {
+		t.Fatalf("expected a rotated file, err %v", err)
+	}
+	if _, err := os.Stat(testFileName + ".2"); !os.IsNotExist(err) {
+		t.Fatalf("expected only one rotated file, err %v", err)
+	}
+
+	// every entry triggers a rotation, so the current file is empty and the
+	// rotated one has the last entry
+	recent = nil
+	loadRecent()
+	if len(recent) != 0 {
+		t.Fatalf("expected the current file to be empty %#v", recent)
+	}
+
+	cfg.Logfile = testFileName + ".1"
+	loadRecent()
+	if e := Recent(5); len(e) != 1 || e[0].Nick != "second" {
+		t.Fatalf("unexpected entries %#v", e)
+	}
+}
@@ -0,0 +1,244 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package commands routes the "." and "!" prefixed messages to the commands
+// registered for them and generates the help of the commands, both for irc
+// and the website
+package commands
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sirc"
+)
+
+const (
+	// Admin is the prefix of the administrative commands
+	Admin = "."
+	// Public is the prefix of the commands everyone can use
+	Public = "!"
+)
+
+// Handler handles the command, args is everything after the name of the
+// command with the surrounding whitespace trimmed, user is the account of the
+// sender or empty if the command does not need one, returns the outcome for
+// the audit log, one of the outcomes below or something more specific
+type Handler func(c *sirc.IConn, m *irc.Message, args, user string) string
+
+// the outcomes of the commands
+const (
+	OK        = "ok"
+	Usage     = "usage"     // invalid arguments
+	NotFound  = "not found" // nothing to act on
+	Unchanged = "unchanged" // nothing to do, it already was that way
+	Denied    = "denied"    // the sender is not allowed to do it
+	Refused   = "refused"   // it would conflict with what is already there
+)
+
+type Command struct {
+	Prefix string
+	Name   string
+	// Args is the usage of the arguments, like "<factoid> [nick]"
+	Args string
+	// Group is the heading the command is listed under in the help
+	Group string
+	// Permission is the permission the sender needs, empty if everyone can
+	// use the command, the router does not check it, whoever dispatches the
+	// commands has to
+	Permission string
+	// Account is whether the sender needs to be identified with services,
+	// implied by Permission
+	Account bool
+	// Description can have multiple lines separated by \n
+	Description string
+	Handle      Handler
+}
+
+// String returns the command with its prefix, like ".add"
+func (c Command) String() string {
+	return c.Prefix + c.Name
+}
+
+// Usage returns the command with its arguments
+func (c Command) Usage() string {
+	if c.Args == "" {
+		return c.String()
+	}
+	return c.String() + " " + c.Args
+}
+
+// ArgList returns the arguments one by one, for the website
+func (c Command) ArgList() []string {
+	return strings.Fields(c.Args)
+}
+
+// Lines returns the lines of the description
+func (c Command) Lines() []string {
+	return strings.Split(c.Description, "\n")
+}
+
+// NeedsAccount returns whether the account of the sender has to be resolved
+// before the command can be handled
+func (c Command) NeedsAccount() bool {
+	return c.Account || c.Permission != ""
+}
+
+// Group is the commands under one heading in the order they were registered
+type Group struct {
+	Name     string
+	Commands []Command
+}
+
+// Router is safe for concurrent use, the zero value is ready to use
+type Router struct {
+	mu    sync.RWMutex
+	cmds  map[string]Command
+	order []string // the keys of cmds in the order they were registered
+}
+
+// Register adds the commands, registering a command twice is a programming
+// error and panics, like with http.ServeMux
+func (r *Router) Register(cmds ...Command) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cmds == nil {
+		r.cmds = make(map[string]Command, len(cmds))
+	}
+	for _, cmd := range cmds {
+		cmd.Name = strings.ToLower(cmd.Name)
+		key := cmd.String()
+		if _, ok := r.cmds[key]; ok {
+			panic("commands: " + key + " registered twice")
+		}
+		r.cmds[key] = cmd
+		r.order = append(r.order, key)
+	}
+}
+
+// Match parses the message text and returns the command it invokes with the
+// arguments
+func (r *Router) Match(text string) (cmd Command, args string, ok bool) {
+	if !strings.HasPrefix(text, Admin) && !strings.HasPrefix(text, Public) {
+		return
+	}
+
+	key := text
+	if pos := strings.IndexAny(text, " \t"); pos > 0 {
+		key, args = text[:pos], strings.TrimSpace(text[pos:])
+	}
+
+	r.mu.RLock()
+	cmd, ok = r.cmds[strings.ToLower(key)]
+	r.mu.RUnlock()
+	if !ok {
+		args = ""
+	}
+	return
+}
+
+// Lookup returns the commands with the name, the prefix is optional, without
+// it both the public and the administrative command is returned
+func (r *Router) Lookup(name string) []Command {
+	name = strings.ToLower(name)
+	keys := []string{name}
+	if !strings.HasPrefix(name, Admin) && !strings.HasPrefix(name, Public) {
+		keys = []string{Public + name, Admin + name}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var ret []Command
+	for _, key := range keys {
+		if cmd, ok := r.cmds[key]; ok {
+			ret = append(ret, cmd)
+		}
+	}
+	return ret
+}
+
+// Groups returns the commands grouped by their headings, the groups and the
+// commands in them are in the order they were registered
+func (r *Router) Groups() []Group {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var ret []Group
+	pos := map[string]int{}
+	for _, key := range r.order {
+		cmd := r.cmds[key]
+		i, ok := pos[cmd.Group]
+		if !ok {
+			i = len(ret)
+			pos[cmd.Group] = i
+			ret = append(ret, Group{Name: cmd.Group})
+		}
+		ret[i].Commands = append(ret[i].Commands, cmd)
+	}
+
+	return ret
+}
+
+// Help returns the lines to send as the answer to !help, the list of commands
+// if name is empty, the usage and the description of the command otherwise
+func (r *Router) Help(name string) []string {
+	if name == "" {
+		r.mu.RLock()
+		keys := make([]string, len(r.order))
+		copy(keys, r.order)
+		r.mu.RUnlock()
+
+		sort.Strings(keys)
+		return []string{
+			"Commands: " + strings.Join(keys, " "),
+			"Use " + Public + "help <command> for the details",
+		}
+	}
+
+	cmds := r.Lookup(name)
+	if len(cmds) == 0 {
+		return []string{"No such command: " + name}
+	}
+
+	var ret []string
+	for _, cmd := range cmds {
+		ret = append(ret, "Usage: "+cmd.Usage())
+		ret = append(ret, cmd.Lines()...)
+	}
+	return ret
+}
+
+// Default is the router of the bot
+var Default = &Router{}
+
+// Register adds the commands to the default router
+func Register(cmds ...Command) { Default.Register(cmds...) }
+
+// Match matches the text against the commands of the default router
+func Match(text string) (Command, string, bool) { return Default.Match(text) }
+
+// Groups returns the groups of the commands of the default router
+func Groups() []Group { return Default.Groups() }
+
+// Help returns the help for the commands of the default router
+func Help(name string) []string { return Default.Help(name) }
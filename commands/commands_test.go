@@ -0,0 +1,107 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package commands
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testRouter() *Router {
+	r := &Router{}
+	r.Register(
+		Command{Prefix: Public, Name: "tag", Args: "<tag>", Group: "List", Description: "Lists the tagged factoids."},
+		Command{Prefix: Admin, Name: "add", Args: "<factoid> <text>", Group: "Admin", Permission: "factoids", Description: "Adds a factoid.\nOr modifies it."},
+		Command{Prefix: Admin, Name: "Tag", Args: "<factoid> <tag>", Group: "List", Permission: "factoids", Description: "Tags a factoid."},
+	)
+	return r
+}
+
+func TestMatch(t *testing.T) {
+	r := testRouter()
+	tests := []struct {
+		text, cmd, args string
+		ok              bool
+	}{
+		{"!tag boot", "!tag", "boot", true},
+		{".TAG foo  boot ", ".tag", "foo  boot", true},
+		{".add", ".add", "", true},
+		{"!add foo", "", "", false},
+		{"add foo", "", "", false},
+		{"!tagged", "", "", false},
+	}
+
+	for _, test := range tests {
+		cmd, args, ok := r.Match(test.text)
+		if ok != test.ok || (ok && cmd.String() != test.cmd) || args != test.args {
+			t.Errorf("%q: got %q %q %v, want %q %q %v", test.text, cmd.String(), args, ok, test.cmd, test.args, test.ok)
+		}
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a command twice to panic")
+		}
+	}()
+
+	r := testRouter()
+	r.Register(Command{Prefix: Admin, Name: "add"})
+}
+
+func TestGroups(t *testing.T) {
+	var got [][]string
+	for _, g := range testRouter().Groups() {
+		names := []string{g.Name}
+		for _, cmd := range g.Commands {
+			names = append(names, cmd.String())
+		}
+		got = append(got, names)
+	}
+
+	want := [][]string{{"List", "!tag", ".tag"}, {"Admin", ".add"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	r := testRouter()
+	tests := map[string][]string{
+		"": {
+			"Commands: !tag .add .tag",
+			"Use !help <command> for the details",
+		},
+		"add": {"Usage: .add <factoid> <text>", "Adds a factoid.", "Or modifies it."},
+		"tag": {
+			"Usage: !tag <tag>", "Lists the tagged factoids.",
+			"Usage: .tag <factoid> <tag>", "Tags a factoid.",
+		},
+		".tag": {"Usage: .tag <factoid> <tag>", "Tags a factoid."},
+		"nope": {"No such command: nope"},
+	}
+
+	for name, want := range tests {
+		if got := r.Help(name); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+}
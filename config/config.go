@@ -32,11 +32,36 @@ import (
 
 type Website struct {
 	Addr string
+	// the address of the admin endpoints, a path means a unix socket, empty
+	// serves them on Addr
+	AdminAddr string `toml:"adminaddr"`
+	// serve the website with TLS on TLSAddr if the certificate is set, Addr
+	// redirects to it if Redirect is set, except the github hook
+	TLSAddr  string `toml:"tlsaddr"`
+	CertFile string `toml:"certfile"`
+	KeyFile  string `toml:"keyfile"`
+	Redirect bool   `toml:"redirect"`
+	// the addresses or networks of the reverse proxies whose X-Forwarded-*
+	// headers are trusted
+	TrustedProxies []string `toml:"trustedproxies"`
+	// how many seconds to wait for the requests in progress and the irc
+	// server on shutdown
+	ShutdownTimeout int `toml:"shutdowntimeout"`
 }
 
 type Debug struct {
 	Debug   bool
 	Logfile string
+	// debug, info, warn or error, debug if Debug is set, info otherwise
+	Level string `toml:"level"`
+	// logfmt, json or journald
+	Format string `toml:"format"`
+	// the logfile is rotated once bigger than MaxSize bytes or older than
+	// MaxAge hours, 0 means no limit
+	MaxSize  int64 `toml:"maxsize"`
+	MaxAge   int   `toml:"maxage"`
+	Keep     int   `toml:"keep"`
+	Compress bool  `toml:"compress"`
 }
 
 type Github struct {
@@ -46,8 +71,19 @@ type Github struct {
 }
 
 type Factoids struct {
+	HookPath       string   `toml:"hookpath"`
+	TplPath        string   `toml:"tplpath"`
+	Superadmins    []string `toml:"superadmins"`
+	ApprovalSecret string   `toml:"approvalsecret"`
+}
+
+type Audit struct {
+	Logfile  string `toml:"logfile"`
+	MaxSize  int64  `toml:"maxsize"`
+	Keep     int    `toml:"keep"`
 	HookPath string `toml:"hookpath"`
 	TplPath  string `toml:"tplpath"`
+	Password string `toml:"password"`
 }
 
 type IRC struct {
@@ -55,27 +91,81 @@ type IRC struct {
 	Nick     string
 	Password string
 	Channels []string
+	// sent with QUIT on shutdown
+	QuitMessage string `toml:"quitmessage"`
+
+	TLS        bool   `toml:"tls"`
+	CAFile     string `toml:"cafile"`
+	ServerName string `toml:"servername"`
+	CertFile   string `toml:"certfile"`
+	KeyFile    string `toml:"keyfile"`
 }
 
 type Nickserv struct {
 	Password string
+	Account  string `toml:"account"`
+	SASL     string `toml:"sasl"`
+	Services string `toml:"services"`
+	CacheTTL int    `toml:"cachettl"`
+}
+
+type Modules struct {
+	// the names of the modules not to load: "factoids", "github"
+	Disabled []string `toml:"disabled"`
 }
 
 type AppConfig struct {
+	// the accounts that always have the owner role
+	Owners []string `toml:"owners"`
 	Website
 	Debug
 	Github
 	Factoids
+	Audit
 	IRC `toml:"irc"`
 	Nickserv
+	Modules
 }
 
-const sampleconf = `[website]
+const sampleconf = `owners=[]
+
+[website]
 addr=":80"
+# serve the metrics, health checks, the audit log and pprof on a separate
+# address, like "127.0.0.1:8080" or a unix socket "/run/sd-bot/admin.sock"
+# empty serves them on addr, except pprof
+adminaddr=""
+# serve the website with TLS on tlsaddr too, the certificate is loaded again
+# when the files change; redirect makes addr redirect to https, except the
+# github hook, github does not follow redirects
+tlsaddr=":443"
+certfile=""
+keyfile=""
+redirect=false
+# the reverse proxies whose X-Forwarded-For/Proto/Host headers are trusted,
+# addresses or networks, like "127.0.0.1" or "10.0.0.0/8"
+trustedproxies=[]
+shutdowntimeout=10
 
 [debug]
 debug=false
 logfile="logs/debug.txt"
+# the minimum level logged: "debug", "info", "warn" or "error", empty for
+# "debug" if debug is true, "info" otherwise
+level=""
+# "logfmt", "json" or "journald", the logfile is not used with journald
+format="logfmt"
+# rotate the logfile once it is bigger than maxsize bytes or older than maxage
+# hours, 0 disables the limit, keep that many rotated files, gzipped if
+# compress is true; the logfile is reopened on SIGUSR1 for external rotation
+maxsize=10485760
+maxage=0
+keep=5
+compress=true
+
+[modules]
+# the modules not to load: "factoids", "github"
+disabled=[]
 
 [github]
 hookpath="somethingrandom"
@@ -85,15 +175,46 @@ announcechan="#systemd"
 [factoids]
 hookpath="/"
 tplpath="tpl/factoid.tpl"
+superadmins=[]
+approvalsecret=""
+
+[audit]
+logfile="logs/audit.log"
+maxsize=10485760
+keep=5
+hookpath="/audit"
+tplpath="tpl/audit.tpl"
+password=""
 
 [irc]
 addr="irc.freenode.net:6667"
 nick="sd-bot"
 password=""
 channels=["#systemd"]
+quitmessage="Shutting down"
+# connect with TLS, usually on port 6697
+tls=false
+# the CA bundle to verify the server with, the system roots if empty
+cafile=""
+# the name to verify the certificate of the server against, the host in
+# addr if empty
+servername=""
+# the client certificate for CertFP and SASL EXTERNAL
+certfile=""
+keyfile=""
 
 [nickserv]
 password=""
+# defaults to the nick of the bot
+account=""
+# "plain" (needs the password), "external" (needs a client certificate)
+# or "" to identify with a PRIVMSG to NickServ after connecting
+sasl="plain"
+# the services the network runs: "atheme" (Libera, freenode), "anope" or "oftc"
+services="atheme"
+# how many seconds the account of a nick is remembered, 0 for as long as
+# the bot shares a channel with it
+cachettl=3600
 `
 
 var (
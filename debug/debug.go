@@ -28,9 +28,11 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sztanpet/sd-bot/config"
@@ -42,114 +44,109 @@ const (
 	DisableDebug = false
 )
 
-var (
-	mu               sync.RWMutex
-	debuggingEnabled bool
-)
+// guards minLevel
+var mu sync.RWMutex
 
-// Init initializes the printing of debugging information based on its arg
+// Init sets up the logging based on the debug section of the config: the
+// minimum level, the format and the logfile, the logfile is only opened when
+// journald is not used or not reachable
 func Init(ctx context.Context) context.Context {
 	cfg := config.FromContext(ctx).Debug
 
-	mu.Lock()
-	debuggingEnabled = cfg.Debug
-	mu.Unlock()
+	level := LevelInfo
+	if cfg.Debug {
+		level = LevelDebug
+	}
+	if cfg.Level != "" {
+		var err error
+		if level, err = ParseLevel(cfg.Level); err != nil {
+			panic(err)
+		}
+	}
+
+	// for everything still using the log package
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	if cfg.Format == "journald" {
+		jb, err := newJournaldBackend()
+		if err == nil {
+			// systemd forwards stderr to the journal too
+			log.SetOutput(os.Stderr)
+			setOutput(jb, level)
+			return ctx
+		}
+		defer Warn("Could not connect to journald, logging in logfmt", "err", err)
+	}
 
 	logfile := cfg.Logfile
-	w, err := os.OpenFile(logfile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0660)
+	maxAge := time.Duration(cfg.MaxAge) * time.Hour
+	w, err := openRotatingFile(logfile, cfg.MaxSize, maxAge, cfg.Keep, cfg.Compress)
 	if err != nil {
 		panic(logfile + err.Error())
 	}
+	reopenOnSignal(w)
 	mw := io.MultiWriter(os.Stderr, w)
 	log.SetOutput(mw)
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	var b backend
+	switch cfg.Format {
+	case "", "logfmt", "journald":
+		b = &logfmtBackend{w: mw}
+	case "json":
+		b = &jsonBackend{w: mw}
+	default:
+		panic("unknown log format: " + cfg.Format)
+	}
+	setOutput(b, level)
 
 	return ctx
 }
 
-func shouldPrint() bool {
-	mu.RLock()
-	defer mu.RUnlock()
-	return debuggingEnabled
+// reopenOnSignal reopens the logfile on SIGUSR1, for external log rotation
+func reopenOnSignal(w *rotatingFile) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			if err := w.Reopen(); err != nil {
+				Error("Could not reopen the logfile", "err", err)
+				continue
+			}
+			Info("Reopened the logfile")
+		}
+	}()
 }
 
-func getFormatStr(numargs int, addlineinfo bool) string {
-	var formatStr string
-	if addlineinfo {
-		formatStr = "%+v:%+v \n  "
-	} else {
-		formatStr = "\n  "
-	}
-	for i := numargs; i >= 1; i-- {
-		formatStr += "|%+v|\n  "
+// sprint formats the arguments with %+v separated by spaces
+func sprint(args ...interface{}) string {
+	ret := make([]string, len(args))
+	for i, arg := range args {
+		ret[i] = fmt.Sprintf("%+v", arg)
 	}
-	formatStr += "\n\n"
-	return formatStr
-}
-
-func logWithCaller(file string, line int, args ...interface{}) {
-	pos := strings.LastIndex(file, "sd-bot/") + len("sd-bot/")
-	newargs := make([]interface{}, 0, len(args)+2)
-	newargs = append(newargs, file[pos:], line)
-	newargs = append(newargs, args...)
-	log.Printf(getFormatStr(len(args), true), newargs...)
+	return strings.Join(ret, " ")
 }
 
 // D prints debug info about its arguments depending on whether debug printing
 // is enabled or not
 func D(args ...interface{}) {
-	if shouldPrint() {
-		_, file, line, ok := runtime.Caller(1)
-		if ok {
-			logWithCaller(file, line, args...)
-		} else {
-			log.Printf(getFormatStr(len(args), false), args...)
-		}
-	}
+	output(LevelDebug, 1, sprint(args...), nil)
 }
 
 // DF prints debug info and allows specifying how many stack frames to skip and
 // expects a format string, only prints if debug printing is enabled
 func DF(skip int, format string, args ...interface{}) {
-	if !shouldPrint() {
-		return
-	}
-
-	_, file, line, ok := runtime.Caller(skip)
-	if ok {
-		pos := strings.LastIndex(file, "sd-bot/") + len("sd-bot/")
-		newargs := make([]interface{}, 0, len(args)+2)
-		newargs = append(newargs, file[pos:], line)
-		newargs = append(newargs, args...)
-		log.Printf("%+v:%+v "+format+"\n", newargs...)
-	} else {
-		log.Printf(format, args...)
-	}
+	output(LevelDebug, skip, fmt.Sprintf(format, args...), nil)
 }
 
-// P prints debug info about its arguments always
+// P prints info about its arguments always
 func P(args ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if ok {
-		logWithCaller(file, line, args...)
-	} else {
-		log.Printf(getFormatStr(len(args), false), args...)
-	}
+	output(LevelInfo, 1, sprint(args...), nil)
 }
 
-// PF prints debug info and allows specifying how many stack frames to skip and
+// PF prints info and allows specifying how many stack frames to skip and
 // expects a format string, always prints
 func PF(skip int, format string, args ...interface{}) {
-	_, file, line, ok := runtime.Caller(skip)
-	if ok {
-		pos := strings.LastIndex(file, "sd-bot/") + len("sd-bot/")
-		newargs := make([]interface{}, 0, len(args)+2)
-		newargs = append(newargs, file[pos:], line)
-		newargs = append(newargs, args...)
-		log.Printf("%+v:%+v "+format+"\n", newargs...)
-	} else {
-		log.Printf(format, args...)
-	}
+	output(LevelInfo, skip, fmt.Sprintf(format, args...), nil)
 }
 
 // F calls panic with a formatted string based on its arguments
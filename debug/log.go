@@ -0,0 +1,356 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package d
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+// the syslog priorities of the levels for journald, see syslog(3)
+var levelPriorities = [...]int{7, 6, 4, 3}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a level, case insensitively
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(l), nil
+		}
+	}
+	return LevelInfo, errors.New("unknown log level: " + s)
+}
+
+// record is a single log entry
+type record struct {
+	time  time.Time
+	level Level
+	msg   string
+	file  string
+	line  int
+	fn    string
+	// key, value pairs
+	fields []interface{}
+}
+
+// newRecord creates the record with the caller skip frames above its caller
+func newRecord(level Level, skip int, msg string, fields []interface{}) *record {
+	r := &record{
+		time:   time.Now(),
+		level:  level,
+		msg:    msg,
+		fields: fields,
+	}
+	if len(r.fields)%2 != 0 {
+		r.fields = append(r.fields[:len(r.fields)-1:len(r.fields)-1], "extra", r.fields[len(r.fields)-1])
+	}
+
+	if pc, file, line, ok := runtime.Caller(skip + 1); ok {
+		r.file, r.line = file, line
+		if fn := runtime.FuncForPC(pc); fn != nil {
+			r.fn = fn.Name()
+		}
+	}
+
+	return r
+}
+
+// shortFile returns the file with only its directory, like "factoids/tpl.go"
+func (r *record) shortFile() string {
+	return filepath.Join(filepath.Base(filepath.Dir(r.file)), filepath.Base(r.file))
+}
+
+// each calls f with every field, the keys are converted to strings
+func (r *record) each(f func(key string, value interface{})) {
+	for i := 0; i < len(r.fields); i += 2 {
+		f(fmt.Sprint(r.fields[i]), r.fields[i+1])
+	}
+}
+
+type backend interface {
+	write(r *record) error
+}
+
+// logfmtBackend writes lines like: time=... level=info msg="..." key=value
+type logfmtBackend struct {
+	w io.Writer
+}
+
+func (b *logfmtBackend) write(r *record) error {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("time=")
+	buf.WriteString(r.time.Format(time.RFC3339Nano))
+	buf.WriteString(" level=")
+	buf.WriteString(r.level.String())
+	if r.file != "" {
+		buf.WriteString(" caller=")
+		buf.WriteString(r.shortFile())
+		buf.WriteByte(':')
+		buf.WriteString(strconv.Itoa(r.line))
+	}
+	buf.WriteString(" msg=")
+	buf.WriteString(logfmtValue(r.msg))
+	r.each(func(key string, value interface{}) {
+		buf.WriteByte(' ')
+		buf.WriteString(strings.Map(func(r rune) rune {
+			if r <= ' ' || r == '=' || r == '"' {
+				return '_'
+			}
+			return r
+		}, key))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(fmt.Sprintf("%+v", value)))
+	})
+	buf.WriteByte('\n')
+
+	_, err := b.w.Write(buf.Bytes())
+	return err
+}
+
+// logfmtValue quotes the value if needed
+func logfmtValue(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// jsonBackend writes one json object per line
+type jsonBackend struct {
+	w io.Writer
+}
+
+func (b *jsonBackend) write(r *record) error {
+	m := make(map[string]interface{}, len(r.fields)/2+5)
+	r.each(func(key string, value interface{}) {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		m[key] = value
+	})
+	m["time"] = r.time.Format(time.RFC3339Nano)
+	m["level"] = r.level.String()
+	m["msg"] = r.msg
+	if r.file != "" {
+		m["file"] = r.shortFile()
+		m["line"] = r.line
+	}
+
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = b.w.Write(append(buf, '\n'))
+	return err
+}
+
+// the socket of the native journal protocol, see systemd-journald.service(8)
+const journalSocket = "/run/systemd/journal/socket"
+
+// journaldBackend sends the records over the native journal protocol
+type journaldBackend struct {
+	conn *net.UnixConn
+	// SYSLOG_IDENTIFIER
+	identifier string
+}
+
+func newJournaldBackend() (*journaldBackend, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldBackend{
+		conn:       conn,
+		identifier: filepath.Base(os.Args[0]),
+	}, nil
+}
+
+func (b *journaldBackend) write(r *record) error {
+	buf := bytes.NewBuffer(nil)
+	journalField(buf, "MESSAGE", r.msg)
+	journalField(buf, "PRIORITY", strconv.Itoa(levelPriorities[r.level]))
+	journalField(buf, "SYSLOG_IDENTIFIER", b.identifier)
+	if r.file != "" {
+		journalField(buf, "CODE_FILE", r.file)
+		journalField(buf, "CODE_LINE", strconv.Itoa(r.line))
+		journalField(buf, "CODE_FUNC", r.fn)
+	}
+	r.each(func(key string, value interface{}) {
+		journalField(buf, journalKey(key), fmt.Sprintf("%+v", value))
+	})
+
+	_, err := b.conn.Write(buf.Bytes())
+	if isTooBig(err) {
+		return b.writeFile(buf.Bytes())
+	}
+	return err
+}
+
+// isTooBig returns whether the error means the datagram was too big
+func isTooBig(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.EMSGSIZE || err == syscall.ENOBUFS
+}
+
+// writeFile passes the entry too big for a datagram in a deleted temporary
+// file, journald only accepts the ones in /dev/shm (or memfds)
+func (b *journaldBackend) writeFile(entry []byte) error {
+	f, err := ioutil.TempFile("/dev/shm", "sd-bot-journal")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_ = os.Remove(f.Name())
+
+	if _, err := f.Write(entry); err != nil {
+		return err
+	}
+
+	_, _, err = b.conn.WriteMsgUnix(nil, syscall.UnixRights(int(f.Fd())), nil)
+	return err
+}
+
+// journalField appends the field in the native journal format, values with
+// newlines are length prefixed
+func journalField(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalKey converts the key to a valid journal field name: uppercase
+// letters, digits and underscores, not starting with an underscore or a digit
+func journalKey(key string) string {
+	key = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+
+	key = strings.TrimLeft(key, "_")
+	if key == "" || (key[0] >= '0' && key[0] <= '9') {
+		key = "F_" + key
+	}
+	return key
+}
+
+var (
+	outMu sync.Mutex
+	out   backend = &logfmtBackend{w: os.Stderr}
+	// the minimum level that is written
+	minLevel = LevelInfo
+)
+
+// setOutput sets the backend and the minimum level
+func setOutput(b backend, level Level) {
+	outMu.Lock()
+	out = b
+	outMu.Unlock()
+
+	mu.Lock()
+	minLevel = level
+	mu.Unlock()
+}
+
+func enabled(level Level) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return level >= minLevel
+}
+
+// output writes the record if the level is enabled, skip is the number of
+// stack frames above the caller of output to report as the caller
+func output(level Level, skip int, msg string, fields []interface{}) {
+	if !enabled(level) {
+		return
+	}
+
+	r := newRecord(level, skip+1, msg, fields)
+	outMu.Lock()
+	err := out.write(r)
+	outMu.Unlock()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not write the log:", err, r.msg)
+	}
+}
+
+// Debug logs the message with the key, value pairs in fields:
+// d.Debug("lookup finished", "nick", nick, "took", time.Since(start))
+func Debug(msg string, fields ...interface{}) { output(LevelDebug, 1, msg, fields) }
+
+// Info logs the message with the key, value pairs in fields
+func Info(msg string, fields ...interface{}) { output(LevelInfo, 1, msg, fields) }
+
+// Warn logs the message with the key, value pairs in fields
+func Warn(msg string, fields ...interface{}) { output(LevelWarn, 1, msg, fields) }
+
+// Error logs the message with the key, value pairs in fields
+func Error(msg string, fields ...interface{}) { output(LevelError, 1, msg, fields) }
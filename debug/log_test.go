@@ -0,0 +1,113 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package d
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogfmt(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	setOutput(&logfmtBackend{w: buf}, LevelInfo)
+	defer setOutput(&logfmtBackend{w: buf}, LevelInfo)
+
+	Debug("hidden")
+	Warn("lookup failed", "nick", "armin", "err", errors.New("timed out"), "odd")
+
+	line := buf.String()
+	for _, want := range []string{
+		" level=warn ",
+		" caller=debug/log_test.go:",
+		` msg="lookup failed" nick=armin err="timed out" extra=odd` + "\n",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("expected %q in %q", want, line)
+		}
+	}
+	if strings.Contains(line, "hidden") {
+		t.Errorf("the debug message should not be logged: %q", line)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	setOutput(&jsonBackend{w: buf}, LevelDebug)
+	defer setOutput(&logfmtBackend{w: buf}, LevelInfo)
+
+	D("request", 1)
+	Error("save failed", "err", errors.New("disk full"), "count", 2)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", lines)
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["level"] != "error" || m["msg"] != "save failed" || m["err"] != "disk full" ||
+		m["count"] != float64(2) || m["file"] != "debug/log_test.go" {
+		t.Errorf("unexpected entry %v", m)
+	}
+	if !strings.Contains(lines[0], `"msg":"request 1"`) {
+		t.Errorf("unexpected entry %q", lines[0])
+	}
+}
+
+func TestJournalField(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	journalField(buf, "MESSAGE", "hello")
+	journalField(buf, "TEXT", "a\nb")
+
+	want := bytes.NewBufferString("MESSAGE=hello\nTEXT\n")
+	_ = binary.Write(want, binary.LittleEndian, uint64(3))
+	want.WriteString("a\nb\n")
+	if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+		t.Errorf("got %q, want %q", buf.Bytes(), want.Bytes())
+	}
+
+	for key, want := range map[string]string{
+		"nick":      "NICK",
+		"took-ms":   "TOOK_MS",
+		"_private":  "PRIVATE",
+		"2fa":       "F_2FA",
+		"":          "F_",
+		"MixedCase": "MIXEDCASE",
+	} {
+		if got := journalKey(key); got != want {
+			t.Errorf("%q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if l, err := ParseLevel("WARN"); err != nil || l != LevelWarn {
+		t.Errorf("got %v, %v", l, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,221 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package d
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rotatingFile is the logfile, it is rotated once it grows bigger than
+// maxSize or gets older than maxAge, the rotated files are logfile.1,
+// logfile.2 and so on (with .gz appended if compressed), the oldest ones
+// beyond keep are deleted, compressing happens in the background
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64         // 0 means no limit
+	maxAge   time.Duration // 0 means no limit
+	keep     int
+	compress bool
+
+	f    *os.File
+	size int64
+	// when the bot started writing the file, the age is measured from it
+	opened time.Time
+	// done once the last rotated file is compressed
+	compressing sync.WaitGroup
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, keep int, compress bool) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		keep:     keep,
+		compress: compress,
+	}
+	return r, r.open()
+}
+
+// open opens the logfile, the lock needs to be held by the caller
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = info.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.needsRotation(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			// keep logging into the old file rather than losing the lines
+			os.Stderr.WriteString("Could not rotate the logfile: " + err.Error() + "\n")
+		}
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// the lock needs to be held by the caller
+func (r *rotatingFile) needsRotation(n int64) bool {
+	if r.f == nil || r.size == 0 {
+		return false
+	}
+	if r.maxSize > 0 && r.size+n > r.maxSize {
+		return true
+	}
+	return r.maxAge > 0 && time.Since(r.opened) > r.maxAge
+}
+
+// Reopen closes and reopens the logfile, for when it was moved by an external
+// tool like logrotate
+func (r *rotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f != nil {
+		_ = r.f.Close()
+		r.f = nil
+	}
+	return r.open()
+}
+
+// rotated returns the path of the nth rotated file
+func (r *rotatingFile) rotated(n int) string {
+	if r.compress {
+		return r.plain(n) + ".gz"
+	}
+	return r.plain(n)
+}
+
+// plain returns the path of the nth rotated file without compression, where
+// the files that could not be compressed are kept
+func (r *rotatingFile) plain(n int) string {
+	return r.path + "." + strconv.Itoa(n)
+}
+
+// rotate moves logfile to logfile.1, logfile.1 to logfile.2 and so on, keeping
+// at most keep rotated files, the lock needs to be held by the caller
+func (r *rotatingFile) rotate() error {
+	// the previous rotated file has to be in place before shifting the files
+	r.compressing.Wait()
+	_ = r.f.Close()
+	r.f = nil
+
+	if r.keep <= 0 {
+		if err := os.Remove(r.path); err != nil {
+			return err
+		}
+		return r.open()
+	}
+
+	for i := r.keep - 1; i >= 1; i-- {
+		_ = os.Rename(r.rotated(i), r.rotated(i+1))
+		if r.compress {
+			_ = os.Rename(r.plain(i), r.plain(i+1))
+		}
+	}
+
+	if !r.compress {
+		if err := os.Rename(r.path, r.rotated(1)); err != nil {
+			return err
+		}
+		return r.open()
+	}
+
+	// the lines written while compressing go to the new file, without waiting
+	// for the compression
+	tmp := r.path + ".rotating"
+	if err := os.Rename(r.path, tmp); err != nil {
+		return err
+	}
+	r.compressing.Add(1)
+	go r.compressRotated(tmp)
+	return r.open()
+}
+
+// compressRotated compresses the just rotated file into logfile.1.gz, it is
+// kept as logfile.1 if that fails
+func (r *rotatingFile) compressRotated(tmp string) {
+	defer r.compressing.Done()
+
+	err := gzipFile(tmp, r.rotated(1))
+	if err == nil {
+		return
+	}
+	os.Stderr.WriteString("Could not compress the rotated logfile: " + err.Error() + "\n")
+	if err := os.Rename(tmp, r.plain(1)); err != nil {
+		os.Stderr.WriteString("Could not keep the rotated logfile: " + err.Error() + "\n")
+	}
+}
+
+// gzipFile compresses src into dst and deletes src
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+
+	return os.Remove(src)
+}
@@ -0,0 +1,170 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package d
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readGzip(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotateBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd-bot-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "debug.txt")
+	w, err := openRotatingFile(path, 10, 0, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.compressing.Wait()
+
+	if b, _ := ioutil.ReadFile(path); string(b) != "fourth\n" {
+		t.Errorf("unexpected logfile %q", b)
+	}
+	if got := readGzip(t, path+".1.gz"); got != "third\n" {
+		t.Errorf("unexpected first rotated file %q", got)
+	}
+	if got := readGzip(t, path+".2.gz"); got != "second\n" {
+		t.Errorf("unexpected second rotated file %q", got)
+	}
+	if _, err := os.Stat(path + ".3.gz"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 rotated files, err %v", err)
+	}
+}
+
+func TestCompressFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd-bot-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "debug.txt")
+	// the compressed file can not be created in place of a directory
+	if err := os.Mkdir(path+".1.gz", 0770); err != nil {
+		t.Fatal(err)
+	}
+	w, err := openRotatingFile(path, 0, time.Hour, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write([]byte("old\n"))
+	w.opened = time.Now().Add(-2 * time.Hour)
+	w.Write([]byte("new\n"))
+	w.compressing.Wait()
+
+	if b, _ := ioutil.ReadFile(path + ".1"); string(b) != "old\n" {
+		t.Errorf("unexpected rotated file %q", b)
+	}
+	if _, err := os.Stat(path + ".rotating"); !os.IsNotExist(err) {
+		t.Errorf("expected no leftover file, err %v", err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "new\n" {
+		t.Errorf("unexpected logfile %q", b)
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd-bot-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "debug.txt")
+	w, err := openRotatingFile(path, 0, time.Hour, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write([]byte("old\n"))
+	w.opened = time.Now().Add(-2 * time.Hour)
+	w.Write([]byte("new\n"))
+
+	if b, _ := ioutil.ReadFile(path + ".1"); string(b) != "old\n" {
+		t.Errorf("unexpected rotated file %q", b)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "new\n" {
+		t.Errorf("unexpected logfile %q", b)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd-bot-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "debug.txt")
+	w, err := openRotatingFile(path, 0, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write([]byte("before\n"))
+	// like logrotate without copytruncate
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("after\n"))
+
+	if b, _ := ioutil.ReadFile(path + ".moved"); string(b) != "before\n" {
+		t.Errorf("unexpected moved file %q", b)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "after\n" {
+		t.Errorf("unexpected logfile %q", b)
+	}
+}
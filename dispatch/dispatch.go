@@ -0,0 +1,98 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package dispatch delivers irc messages to every handler that registered for
+// the command of the message, in the order they registered, until one of them
+// consumes it
+package dispatch
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sirc"
+)
+
+// Handler gets the message and its IRCv3 tags, it returns true if it consumed
+// the message, no handler after it will see it then
+type Handler func(c *sirc.IConn, m *irc.Message, tags map[string]string) bool
+
+// Observer is a handler that never consumes the message
+type Observer func(c *sirc.IConn, m *irc.Message, tags map[string]string)
+
+type entry struct {
+	commands map[string]struct{} // nil means every command
+	h        Handler
+}
+
+func (e entry) wants(command string) bool {
+	if e.commands == nil {
+		return true
+	}
+	_, ok := e.commands[command]
+	return ok
+}
+
+// Dispatcher is safe for concurrent use, the zero value is ready to use
+type Dispatcher struct {
+	mu       sync.RWMutex
+	handlers []entry
+}
+
+// Handle registers h for the commands, or every command if none are given
+// the commands are case insensitive, numerics are given as strings ("330")
+func (d *Dispatcher) Handle(h Handler, commands ...string) {
+	e := entry{h: h}
+	if len(commands) > 0 {
+		e.commands = make(map[string]struct{}, len(commands))
+		for _, command := range commands {
+			e.commands[strings.ToUpper(command)] = struct{}{}
+		}
+	}
+
+	d.mu.Lock()
+	d.handlers = append(d.handlers, e)
+	d.mu.Unlock()
+}
+
+// Observe registers o for the commands, or every command if none are given
+func (d *Dispatcher) Observe(o Observer, commands ...string) {
+	d.Handle(func(c *sirc.IConn, m *irc.Message, tags map[string]string) bool {
+		o(c, m, tags)
+		return false
+	}, commands...)
+}
+
+// Dispatch calls the handlers registered for the command of m, returns true
+// if one of them consumed it
+func (d *Dispatcher) Dispatch(c *sirc.IConn, m *irc.Message, tags map[string]string) bool {
+	d.mu.RLock()
+	handlers := d.handlers
+	d.mu.RUnlock()
+
+	command := strings.ToUpper(m.Command)
+	for _, e := range handlers {
+		if e.wants(command) && e.h(c, m, tags) {
+			return true
+		}
+	}
+
+	return false
+}
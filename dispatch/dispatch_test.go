@@ -0,0 +1,71 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package dispatch
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sirc"
+)
+
+func TestDispatch(t *testing.T) {
+	var d Dispatcher
+	var got []string
+	d.Observe(func(c *sirc.IConn, m *irc.Message, tags map[string]string) {
+		got = append(got, "all "+m.Command)
+	})
+	d.Observe(func(c *sirc.IConn, m *irc.Message, tags map[string]string) {
+		got = append(got, "nick "+m.Command)
+	}, "nick", irc.QUIT)
+	d.Handle(func(c *sirc.IConn, m *irc.Message, tags map[string]string) bool {
+		got = append(got, "consume "+m.Command)
+		return true
+	}, irc.NOTICE, irc.NICK)
+	d.Observe(func(c *sirc.IConn, m *irc.Message, tags map[string]string) {
+		got = append(got, "late "+m.Command)
+	})
+
+	consumed := map[string]bool{}
+	for _, command := range []string{irc.NICK, irc.QUIT, irc.NOTICE, irc.PRIVMSG} {
+		consumed[command] = d.Dispatch(nil, &irc.Message{Command: command}, nil)
+	}
+
+	want := []string{
+		"all NICK", "nick NICK", "consume NICK",
+		"all QUIT", "nick QUIT", "late QUIT",
+		"all NOTICE", "consume NOTICE",
+		"all PRIVMSG", "late PRIVMSG",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	wantConsumed := map[string]bool{
+		irc.NICK:    true,
+		irc.QUIT:    false,
+		irc.NOTICE:  true,
+		irc.PRIVMSG: false,
+	}
+	if !reflect.DeepEqual(consumed, wantConsumed) {
+		t.Errorf("consumed %v, want %v", consumed, wantConsumed)
+	}
+}
@@ -0,0 +1,166 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package factoids
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sd-bot/commands"
+	"github.com/sztanpet/sirc"
+)
+
+// the permission of the factoid administration commands, see roles.go
+const permFactoids = "factoids"
+
+// adminCommand returns a factoid administration command handled by handleAdmin
+func adminCommand(group, name, args, description string) commands.Command {
+	return commands.Command{
+		Prefix:      commands.Admin,
+		Name:        name,
+		Args:        args,
+		Group:       group,
+		Permission:  permFactoids,
+		Description: description,
+		Handle: func(c *sirc.IConn, m *irc.Message, args, user string) string {
+			return handleAdmin(c, m, user, name, args)
+		},
+	}
+}
+
+// proposalCommand returns a command handled by handleProposalAdmin
+func proposalCommand(name, args, description string) commands.Command {
+	return commands.Command{
+		Prefix:      commands.Admin,
+		Name:        name,
+		Args:        args,
+		Group:       "Review factoid proposals",
+		Permission:  permFactoids,
+		Description: description,
+		Handle: func(c *sirc.IConn, m *irc.Message, args, user string) string {
+			return handleProposalAdmin(c, m, user, name, args)
+		},
+	}
+}
+
+func factoidCommands() []commands.Command {
+	const (
+		list    = "List factoids"
+		admin   = "Administer factoids"
+		tags    = "Administer factoid tags"
+		aliases = "Administer factoid aliases"
+	)
+
+	return []commands.Command{
+		{
+			Prefix:      commands.Public,
+			Name:        "tags",
+			Group:       list,
+			Description: "Lists every tag in use.",
+			Handle: func(c *sirc.IConn, m *irc.Message, args, user string) string {
+				state.Lock()
+				defer state.Unlock()
+				handleTags(c, m, "")
+				return commands.OK
+			},
+		},
+		{
+			Prefix:      commands.Public,
+			Name:        "tag",
+			Args:        "<tag>",
+			Group:       list,
+			Description: "Lists the factoids tagged with the given tag.",
+			Handle: func(c *sirc.IConn, m *irc.Message, args, user string) string {
+				if !alphaRE.MatchString(args) {
+					c.Notice(m, "Usage: !tag <tag>")
+					return commands.Usage
+				}
+				state.Lock()
+				defer state.Unlock()
+				handleTags(c, m, strings.ToLower(args))
+				return commands.OK
+			},
+		},
+		{
+			Prefix:      commands.Public,
+			Name:        "propose",
+			Args:        "<factoid-trigger> <factoid-text>",
+			Group:       list,
+			Account:     true,
+			Description: "Proposes a new factoid or a change to an existing one, the administrators are notified and can approve or reject it.\nOnly available for users identified with services.",
+			Handle: func(c *sirc.IConn, m *irc.Message, args, user string) string {
+				handlePropose(c, m, user, args)
+				return commands.OK
+			},
+		},
+
+		adminCommand(admin, "add", "<factoid-trigger> <factoid-text>",
+			"The factoid-trigger will trigger the factoid, upon which fact the factoid-text will be printed.\n"+
+				`A \n in the factoid-text starts a new line, \\n is a literal \n. Long lines are split automatically.`+"\n"+
+				"This command adds a new factoid."),
+		adminCommand(admin, "mod", "<factoid-trigger> <factoid-text>",
+			"The factoid-trigger will trigger the factoid, upon which fact the factoid-text will be printed.\n"+
+				"This command modifies an existing factoid."),
+		adminCommand(admin, "del", "<factoid-trigger>",
+			"This command deletes an existing factoid with the given trigger and all of its aliases."),
+		adminCommand(admin, "rename", "<old-factoid-trigger> <new-factoid-trigger>",
+			"This command renames an existing factoid to the new trigger, the new trigger must not exist beforehand. Also updates the aliases."),
+		adminCommand(admin, "maxlines", "<factoid-trigger> <line-count>",
+			"Sets the maximum number of lines the factoid prints (at most "+strconv.Itoa(maxMaxLines)+"), the rest is cut off. "+
+				"The default is "+strconv.Itoa(defaultMaxLines)+", a line-count of 0 restores the default."),
+		adminCommand(admin, "lock", "<factoid-trigger>",
+			"Locks the factoid so that only its owner (the administrator who added it) or the superadmins can modify, rename, delete or alias it.\n"+
+				"Factoids without an owner can only be locked by the superadmins, and stay without an owner."),
+		adminCommand(admin, "unlock", "<factoid-trigger>",
+			"Unlocks the factoid so that every administrator can modify it again, only for the owner or the superadmins."),
+
+		proposalCommand("proposals", "", "Lists the pending proposals."),
+		proposalCommand("approve", "<proposal-id>", "Adds or modifies the factoid as proposed."),
+		proposalCommand("reject", "<proposal-id>", "Deletes the proposal without applying it."),
+
+		adminCommand(tags, "tag", "<factoid-trigger> <tag>",
+			"Tags the factoid with the given tag (for example journald, networkd or boot)."),
+		adminCommand(tags, "untag", "<factoid-trigger> <tag>",
+			"Removes the given tag from the factoid."),
+
+		adminCommand(aliases, "addalias", "<alias-trigger> <factoid-trigger>",
+			"The alias-trigger will trigger the factoid-trigger.\nThis command adds a new alias."),
+		adminCommand(aliases, "modalias", "<alias-trigger> <factoid-trigger>",
+			"The alias-trigger will trigger the factoid-trigger.\nThis command modifies an existing alias."),
+		adminCommand(aliases, "delalias", "<alias-trigger>",
+			"This command deletes an existing alias with the given trigger."),
+		{
+			Prefix:      commands.Admin,
+			Name:        "fsck",
+			Args:        "[fix]",
+			Group:       aliases,
+			Permission:  permFactoids,
+			Description: "Reports aliases that do not lead to a factoid (dangling or circular) or are shadowed by a factoid.\nWith \"fix\" the broken aliases are deleted.",
+			Handle: func(c *sirc.IConn, m *irc.Message, args, user string) string {
+				if args != "" && args != "fix" {
+					c.Notice(m, "Usage: .fsck [fix]")
+					return commands.Usage
+				}
+				return handleFsck(c, m, args == "fix")
+			},
+		},
+	}
+}
@@ -20,14 +20,16 @@
 package factoids
 
 import (
-	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sorcix/irc"
+	"github.com/sztanpet/sd-bot/commands"
 	"github.com/sztanpet/sd-bot/config"
 	"github.com/sztanpet/sd-bot/debug"
+	"github.com/sztanpet/sd-bot/metrics"
 	"github.com/sztanpet/sd-bot/persist"
 	"github.com/sztanpet/sirc"
 	"golang.org/x/net/context"
@@ -38,38 +40,67 @@ type st struct {
 	Factoids map[string]string
 	Aliases  map[string]string
 	Used     map[string]time.Time
+	MaxLines map[string]int
+	Tags     map[string][]string
+	Owners   map[string]string
+	Locked   map[string]struct{}
+
+	Proposals    map[int]proposal
+	NextProposal int
 }
 
 var (
 	alphaRE  = regexp.MustCompile(`^[a-zA-Z0-9-.]+$`)
 	handleRE = regexp.MustCompile(`^!([a-zA-Z0-9-.]+)(?:\s+(\S+)\s*)?$`)
-	adminRE  = regexp.MustCompile(`^\.(add|mod|del|rename|addalias|modalias|delalias)(?:\s+([a-zA-Z0-9-.]+)\s*)(?:(\S+))?(?:(.+))?$`)
-	s        *st
-	state    *persist.State
+	// the arguments of the administration commands: the factoid, then the
+	// new name or the first word of the text, then the rest of the text
+	argsRE = regexp.MustCompile(`^([a-zA-Z0-9-.]+)\s*(?:(\S+))?(?:(.+))?$`)
+	s      *st
+	state  *persist.State
+
+	triggers = metrics.NewCounter("sdbot_factoid_triggers_total",
+		"The number of times a factoid was printed.", "factoid")
+	cooldownSuppressions = metrics.NewCounter("sdbot_factoid_cooldown_suppressions_total",
+		"The number of times a factoid (or !tags) was not printed because it was used recently.", "factoid")
 )
 
 func Init(ctx context.Context) context.Context {
 	handleRE.Longest()
-	adminRE.Longest()
+	argsRE.Longest()
 
 	var err error
 	state, err = persist.New("factoids.state", &st{
 		Factoids: map[string]string{},
 		Aliases:  map[string]string{},
 		Used:     map[string]time.Time{},
+		MaxLines: map[string]int{},
+		Tags:     map[string][]string{},
+		Owners:   map[string]string{},
+		Locked:   map[string]struct{}{},
+
+		Proposals: map[int]proposal{},
 	})
 	if err != nil {
 		d.F(err.Error())
 	}
 
 	s = state.Get().(*st)
+	// the owners of the bot can modify every factoid too
+	for _, user := range config.FromContext(ctx).Owners {
+		superadmins[user] = struct{}{}
+	}
+	for _, user := range config.FromContext(ctx).Factoids.Superadmins {
+		superadmins[user] = struct{}{}
+	}
+	if problems := checkIntegrity(s, false); len(problems) > 0 {
+		d.Warn("factoid integrity check failed, use .fsck fix to repair", "problems", problems)
+	}
 
-	tpl.init(config.FromContext(ctx).Factoids.TplPath)
-	path := config.FromContext(ctx).Factoids.HookPath
-	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-		tpl.render()
-		tpl.execute(w)
-	})
+	cfg := config.FromContext(ctx).Factoids
+	approvalSecret = cfg.ApprovalSecret
+	pagePath = cfg.HookPath
+
+	tpl.init(cfg.TplPath)
 
 	return ctx
 }
@@ -77,23 +108,24 @@ func Init(ctx context.Context) context.Context {
 func factoidUsedRecently(factoidkey string) (ret bool) {
 	if lastused, ok := s.Used[factoidkey]; ok && time.Since(lastused) < 30*time.Second {
 		ret = true
+		// the tags come from the channel, every tag would be a new series
+		label := factoidkey
+		if strings.HasPrefix(label, "!tag ") {
+			label = "!tag"
+		}
+		cooldownSuppressions.Inc(label)
 	}
 	s.Used[factoidkey] = time.Now()
 	return
 }
 
 // checks if there is a factoid, if there isnt tries to look if its an alias
-// and then recurses with the found factoid
+// and then follows it to the found factoid
 // the state lock needs to be held by the caller
 func getfactoidByKey(factoidkey string) (factoid, key string, ok bool) {
-	key = factoidkey
-restart:
-	if factoid, ok = s.Factoids[key]; ok {
-		return
-	}
-	key, ok = s.Aliases[key]
+	key, ok = resolveAlias(s, factoidkey)
 	if ok {
-		goto restart
+		factoid = s.Factoids[key]
 	}
 
 	return
@@ -114,10 +146,17 @@ func Handle(c *sirc.IConn, m *irc.Message) (abort bool) {
 		if factoidUsedRecently(factoidkey) {
 			return
 		}
+		triggers.Inc(factoidkey)
 		if len(matches[2]) > 0 { // someone is being sent a factoid
-			c.PrivMsg(m, matches[2], ": ", factoid)
-		} else { // otherwise just print the factoid
-			c.PrivMsg(m, factoid)
+			factoid = matches[2] + ": " + factoid
+		}
+
+		max, ok := s.MaxLines[factoidkey]
+		if !ok {
+			max = defaultMaxLines
+		}
+		for _, line := range limitLines(splitLines(factoid, maxLineLength), max) {
+			c.PrivMsg(m, line)
 		}
 
 		return
@@ -126,126 +165,296 @@ func Handle(c *sirc.IConn, m *irc.Message) (abort bool) {
 	return
 }
 
-func HandleAdmin(c *sirc.IConn, m *irc.Message) (abort bool) {
-	matches := adminRE.FindStringSubmatch(m.Trailing)
+// handleAdmin handles the factoid administration commands, user is the
+// account name of the admin issuing the command, returns the outcome
+func handleAdmin(c *sirc.IConn, m *irc.Message, user, command, args string) string {
+	matches := argsRE.FindStringSubmatch(args)
 	if len(matches) == 0 {
-		return
+		c.Notice(m, "Invalid arguments, see !help ", command)
+		return commands.Usage
 	}
 
-	var savestate bool
-	abort = true
-
-	command := matches[1]
-	factoidkey := strings.ToLower(matches[2])
-	newfactoidkey := strings.ToLower(matches[3])
-	factoid := matches[3]
-	if len(matches[4]) > 0 {
-		factoid = matches[3] + matches[4]
+	// the notice about the change, only sent once it is known to be kept
+	var success []string
+	factoidkey := strings.ToLower(matches[1])
+	newfactoidkey := strings.ToLower(matches[2])
+	factoid := matches[2]
+	if len(matches[3]) > 0 {
+		factoid = matches[2] + matches[3]
 	}
+	factoid = lineBreakReplacer.Replace(factoid)
+
+	state.Lock()
+	defer state.Unlock()
+
+	// a mutation that breaks the integrity of the state is undone
+	before := checkIntegrity(s, false)
+	snapshot := s.clone()
 
 	switch command {
 	case "add":
 		fallthrough
 	case "mod":
-		state.Lock()
-		defer state.Unlock()
+		if _, ok := s.Aliases[factoidkey]; ok {
+			c.Notice(m, factoidkey, " is an alias, please delete it first")
+			return commands.Refused
+		}
+		if !canModify(c, m, user, factoidkey) {
+			return commands.Denied
+		}
 
+		if _, ok := s.Factoids[factoidkey]; !ok {
+			s.Owners[factoidkey] = user
+		}
 		s.Factoids[factoidkey] = factoid
-		savestate = true
-		c.Notice(m, "Added/Modified successfully")
+		success = []string{"Added/Modified successfully"}
 
 	case "del":
-		state.Lock()
-		defer state.Unlock()
+		key, ok := resolveAlias(s, factoidkey)
+		if !ok {
+			c.Notice(m, "Not present")
+			return commands.NotFound
+		}
+		if !canModify(c, m, user, key) {
+			return commands.Denied
+		}
 
-	restartdelete:
-		if _, ok := s.Factoids[factoidkey]; ok {
-			delete(s.Factoids, factoidkey)
-			c.Notice(m, "Deleted successfully")
-			// clean up the aliases too
-			for k, v := range s.Aliases {
-				if v == factoidkey {
-					delete(s.Aliases, k)
-				}
+		// clean up the aliases too, every one that ends up at the factoid,
+		// not just the ones directly pointing at it
+		var aliases []string
+		for k := range s.Aliases {
+			if target, _ := resolveAlias(s, k); target == key {
+				aliases = append(aliases, k)
 			}
-		} else if factoidkey, ok = s.Aliases[factoidkey]; ok {
-			c.Notice(m, "Found an alias, deleting the original factoid")
-			goto restartdelete
 		}
-
-		savestate = true
+		for _, k := range aliases {
+			delete(s.Aliases, k)
+		}
+		delete(s.Factoids, key)
+		delete(s.MaxLines, key)
+		delete(s.Tags, key)
+		delete(s.Owners, key)
+		delete(s.Locked, key)
+		success = []string{"Deleted successfully"}
+		if key != factoidkey {
+			success = []string{"Found an alias, deleted the original factoid ", key, " successfully"}
+		}
 
 	case "rename":
 		if !alphaRE.MatchString(newfactoidkey) {
-			return
+			c.Notice(m, "Invalid arguments, see !help ", command)
+			return commands.Usage
 		}
-		state.Lock()
-		defer state.Unlock()
-
 		if _, ok := s.Factoids[newfactoidkey]; ok {
 			c.Notice(m, "Renaming would overwrite, please delete first")
-			return
+			return commands.Refused
 		}
 		if _, ok := s.Aliases[newfactoidkey]; ok {
 			c.Notice(m, "Renaming would overwrite an alias, please delete first")
-			return
+			return commands.Refused
 		}
 		if _, ok := s.Factoids[factoidkey]; ok {
+			if !canModify(c, m, user, factoidkey) {
+				return commands.Denied
+			}
+
 			s.Factoids[newfactoidkey] = s.Factoids[factoidkey]
 			delete(s.Factoids, factoidkey)
+			if max, ok := s.MaxLines[factoidkey]; ok {
+				s.MaxLines[newfactoidkey] = max
+				delete(s.MaxLines, factoidkey)
+			}
+			if tags, ok := s.Tags[factoidkey]; ok {
+				s.Tags[newfactoidkey] = tags
+				delete(s.Tags, factoidkey)
+			}
+			moveOwnership(factoidkey, newfactoidkey)
 			// rename the aliases too
 			for k, v := range s.Aliases {
 				if v == factoidkey {
 					s.Aliases[k] = newfactoidkey
 				}
 			}
-			savestate = true
-			c.Notice(m, "Renamed successfully")
+			success = []string{"Renamed successfully"}
 		} else {
 			c.Notice(m, "Not present")
+			return commands.NotFound
 		}
 
 	case "addalias":
 		fallthrough
 	case "modalias":
 		if !alphaRE.MatchString(newfactoidkey) {
-			return
+			c.Notice(m, "Invalid arguments, see !help ", command)
+			return commands.Usage
+		}
+
+		if _, ok := s.Factoids[factoidkey]; ok {
+			c.Notice(m, "Alias would shadow the factoid ", factoidkey, ", please delete it first")
+			return commands.Refused
 		}
 
-		state.Lock()
-		defer state.Unlock()
+		// the chain of the target could lead back to the alias, only
+		// visible before resolving it
+		if createsCycle(s, factoidkey, newfactoidkey) {
+			c.Notice(m, "Alias would create a cycle")
+			return commands.Refused
+		}
 
 		// newfactoidkey is the factoid we are going to add an alias for
 		// if itself is an alias, get the original factoid key, that is what
 		// getfactoidByKey does
 		_, newfactoidkey, ok := getfactoidByKey(newfactoidkey)
 		if ok {
+			// the names of a locked factoid are part of it, both the one
+			// the alias pointed at and the new one
+			if old, isAlias := resolveAlias(s, factoidkey); isAlias && !canModify(c, m, user, old) {
+				return commands.Denied
+			}
+			if !canModify(c, m, user, newfactoidkey) {
+				return commands.Denied
+			}
+
 			s.Aliases[factoidkey] = newfactoidkey
-			savestate = true
-			c.Notice(m, "Added/Modified alias for ", newfactoidkey, " successfully")
+			success = []string{"Added/Modified alias for ", newfactoidkey, " successfully"}
 		} else {
 			c.Notice(m, "No factoid with name ", newfactoidkey, " found")
+			return commands.NotFound
 		}
 
 	case "delalias":
-		state.Lock()
-		defer state.Unlock()
+		if target, ok := s.Aliases[factoidkey]; ok {
+			if key, ok := resolveAlias(s, factoidkey); ok && !canModify(c, m, user, key) {
+				return commands.Denied
+			}
 
-		if _, ok := s.Aliases[factoidkey]; ok {
-			c.Notice(m, "Deleted alias successfully")
 			delete(s.Aliases, factoidkey)
-			savestate = true
+			// aliases pointing at this alias would be left dangling, point
+			// them at whatever this alias pointed at
+			for k, v := range s.Aliases {
+				if v == factoidkey {
+					s.Aliases[k] = target
+				}
+			}
+			success = []string{"Deleted alias successfully"}
+		} else {
+			c.Notice(m, "Not present")
+			return commands.NotFound
+		}
+
+	case "maxlines":
+		max, err := strconv.Atoi(strings.TrimSpace(factoid))
+		if err != nil || max < 0 || max > maxMaxLines {
+			c.Notice(m, "The line count has to be between 1 and ", strconv.Itoa(maxMaxLines), ", or 0 to reset it")
+			return commands.Usage
+		}
+
+		_, factoidkey, ok := getfactoidByKey(factoidkey)
+		if !ok {
+			c.Notice(m, "Not present")
+			return commands.NotFound
+		}
+		if !canModify(c, m, user, factoidkey) {
+			return commands.Denied
+		}
+
+		if max == 0 {
+			delete(s.MaxLines, factoidkey)
+		} else {
+			s.MaxLines[factoidkey] = max
+		}
+		success = []string{"Modified the line count of ", factoidkey, " successfully"}
+
+	case "tag":
+		fallthrough
+	case "untag":
+		if !alphaRE.MatchString(newfactoidkey) {
+			c.Notice(m, "Invalid tag")
+			return commands.Usage
+		}
+
+		_, factoidkey, ok := getfactoidByKey(factoidkey)
+		if !ok {
+			c.Notice(m, "Not present")
+			return commands.NotFound
+		}
+		if !canModify(c, m, user, factoidkey) {
+			return commands.Denied
+		}
+
+		if command == "tag" && addTag(s, factoidkey, newfactoidkey) {
+			success = []string{"Tagged ", factoidkey, " with ", newfactoidkey, " successfully"}
+		} else if command == "untag" && delTag(s, factoidkey, newfactoidkey) {
+			success = []string{"Removed tag ", newfactoidkey, " from ", factoidkey, " successfully"}
+		} else {
+			c.Notice(m, "Nothing to do")
+			return commands.Unchanged
+		}
+
+	case "lock":
+		fallthrough
+	case "unlock":
+		_, factoidkey, ok := getfactoidByKey(factoidkey)
+		if !ok {
+			c.Notice(m, "Not present")
+			return commands.NotFound
+		}
+
+		if reason := lockDenied(user, factoidkey); reason != "" {
+			c.Notice(m, reason)
+			return commands.Denied
+		}
+		owner := s.Owners[factoidkey]
+
+		if command == "lock" && owner == "" {
+			s.Locked[factoidkey] = struct{}{}
+			success = []string{"Locked ", factoidkey, " successfully, it has no owner, only superadmins can modify it"}
+		} else if command == "lock" {
+			s.Locked[factoidkey] = struct{}{}
+			success = []string{"Locked ", factoidkey, " successfully, owner is ", owner}
+		} else {
+			delete(s.Locked, factoidkey)
+			success = []string{"Unlocked ", factoidkey, " successfully"}
 		}
 
 	default:
-		abort = false
-		return
+		return commands.Usage
 	}
 
-	if savestate {
+	if success != nil {
+		if problems := newProblems(before, checkIntegrity(s, false)); len(problems) > 0 {
+			*s = *snapshot
+			c.Notice(m, "The change would have broken the factoids, undid it: ", strings.Join(problems, ", "))
+			return "undone"
+		}
 		state.Save(false)
 		tpl.invalidate()
+		c.Notice(m, success...)
 	}
 
-	return
+	return commands.OK
+}
+
+func handleFsck(c *sirc.IConn, m *irc.Message, repair bool) string {
+	state.Lock()
+	defer state.Unlock()
+
+	problems := checkIntegrity(s, repair)
+	if len(problems) == 0 {
+		c.Notice(m, "No problems found")
+		return commands.Unchanged
+	}
+
+	for _, p := range problems {
+		c.Notice(m, p)
+	}
+
+	if repair {
+		state.Save(false)
+		tpl.invalidate()
+		c.Notice(m, "Deleted ", strconv.Itoa(len(problems)), " broken aliases")
+	} else {
+		c.Notice(m, "Use .fsck fix to delete the broken aliases")
+	}
+	return commands.OK
 }
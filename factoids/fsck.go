@@ -0,0 +1,157 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package factoids
+
+import (
+	"sort"
+	"time"
+)
+
+// resolveAlias follows the alias chain starting at key until it reaches a
+// factoid, returns the key of the factoid and whether it was found
+// visits every alias at most once, so cycles terminate
+func resolveAlias(s *st, key string) (string, bool) {
+	seen := make(map[string]struct{}, 1)
+	for {
+		if _, ok := s.Factoids[key]; ok {
+			return key, true
+		}
+		if _, ok := seen[key]; ok { // cycle
+			return key, false
+		}
+		seen[key] = struct{}{}
+
+		next, ok := s.Aliases[key]
+		if !ok { // dangling
+			return key, false
+		}
+		key = next
+	}
+}
+
+// createsCycle reports whether pointing alias at target would make the alias
+// chain starting at target come back to alias
+func createsCycle(s *st, alias, target string) bool {
+	seen := map[string]struct{}{}
+	for key := target; ; {
+		if key == alias {
+			return true
+		}
+		if _, ok := seen[key]; ok {
+			return false
+		}
+		seen[key] = struct{}{}
+
+		next, ok := s.Aliases[key]
+		if !ok {
+			return false
+		}
+		key = next
+	}
+}
+
+// checkIntegrity looks for aliases that do not end up at a factoid (dangling
+// or cyclic) and aliases that are shadowed by a factoid with the same name,
+// if repair is true, the offending aliases are deleted
+// returns a sorted, human readable list of the problems found
+// the state lock needs to be held by the caller
+func checkIntegrity(s *st, repair bool) (problems []string) {
+	var broken []string
+	for alias, target := range s.Aliases {
+		if _, ok := s.Factoids[alias]; ok {
+			problems = append(problems, "alias "+alias+" is shadowed by a factoid")
+			broken = append(broken, alias)
+			continue
+		}
+
+		if key, ok := resolveAlias(s, target); !ok {
+			if createsCycle(s, alias, target) {
+				problems = append(problems, "alias "+alias+" is part of a cycle")
+			} else {
+				problems = append(problems, "alias "+alias+" is dangling, "+key+" does not exist")
+			}
+			broken = append(broken, alias)
+		}
+	}
+
+	if repair {
+		for _, alias := range broken {
+			delete(s.Aliases, alias)
+		}
+	}
+
+	sort.Strings(problems)
+	return
+}
+
+// newProblems returns the problems in after that were not in before, both
+// sorted, as checkIntegrity returns them
+func newProblems(before, after []string) []string {
+	var ret []string
+	for _, p := range after {
+		pos := sort.SearchStrings(before, p)
+		if pos == len(before) || before[pos] != p {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// clone returns a deep copy of the state, for undoing a change
+// the state lock needs to be held by the caller
+func (s *st) clone() *st {
+	ret := &st{
+		Factoids:     make(map[string]string, len(s.Factoids)),
+		Aliases:      make(map[string]string, len(s.Aliases)),
+		Used:         make(map[string]time.Time, len(s.Used)),
+		MaxLines:     make(map[string]int, len(s.MaxLines)),
+		Tags:         make(map[string][]string, len(s.Tags)),
+		Owners:       make(map[string]string, len(s.Owners)),
+		Locked:       make(map[string]struct{}, len(s.Locked)),
+		Proposals:    make(map[int]proposal, len(s.Proposals)),
+		NextProposal: s.NextProposal,
+	}
+	for k, v := range s.Factoids {
+		ret.Factoids[k] = v
+	}
+	for k, v := range s.Aliases {
+		ret.Aliases[k] = v
+	}
+	for k, v := range s.Used {
+		ret.Used[k] = v
+	}
+	for k, v := range s.MaxLines {
+		ret.MaxLines[k] = v
+	}
+	for k, v := range s.Tags {
+		ret.Tags[k] = append([]string(nil), v...)
+	}
+	for k, v := range s.Owners {
+		ret.Owners[k] = v
+	}
+	for k := range s.Locked {
+		ret.Locked[k] = struct{}{}
+	}
+	for k, v := range s.Proposals {
+		ret.Proposals[k] = v
+	}
+
+	return ret
+}
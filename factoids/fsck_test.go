@@ -0,0 +1,93 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package factoids
+
+import (
+	"testing"
+)
+
+func TestIntegrity(t *testing.T) {
+	s := &st{
+		Factoids: map[string]string{
+			"boot":   "text",
+			"shadow": "text",
+		},
+		Aliases: map[string]string{
+			"b":       "boot",
+			"bb":      "b",
+			"shadow":  "boot",
+			"loop1":   "loop2",
+			"loop2":   "loop1",
+			"nothing": "gone",
+		},
+	}
+
+	if key, ok := resolveAlias(s, "bb"); !ok || key != "boot" {
+		t.Fatalf("unexpected resolution of bb: %v %v", key, ok)
+	}
+	if _, ok := resolveAlias(s, "loop1"); ok {
+		t.Fatalf("cycle resolved to a factoid")
+	}
+	if !createsCycle(s, "b", "bb") || createsCycle(s, "x", "bb") {
+		t.Fatalf("unexpected cycle detection")
+	}
+
+	problems := checkIntegrity(s, false)
+	if len(problems) != 4 || len(s.Aliases) != 6 {
+		t.Fatalf("unexpected problems %#v, aliases %#v", problems, s.Aliases)
+	}
+
+	problems = checkIntegrity(s, true)
+	if len(problems) != 4 || len(s.Aliases) != 2 || s.Aliases["bb"] != "b" {
+		t.Fatalf("unexpected problems %#v, aliases %#v", problems, s.Aliases)
+	}
+
+	if problems = checkIntegrity(s, false); len(problems) != 0 {
+		t.Fatalf("unexpected problems after repair %#v", problems)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	s := &st{
+		Factoids: map[string]string{"boot": "text"},
+		Aliases:  map[string]string{"b": "boot"},
+		Tags:     map[string][]string{"boot": {"systemd"}},
+	}
+	before := checkIntegrity(s, false)
+	snapshot := s.clone()
+
+	// deleting the factoid leaves the alias dangling
+	delete(s.Factoids, "boot")
+	s.Tags["boot"][0] = "changed"
+	problems := newProblems(before, checkIntegrity(s, false))
+	if len(problems) != 1 {
+		t.Fatalf("unexpected problems %#v", problems)
+	}
+
+	*s = *snapshot
+	if s.Factoids["boot"] != "text" || s.Tags["boot"][0] != "systemd" {
+		t.Fatalf("the snapshot was not a copy: %#v", s)
+	}
+
+	// the problems that were there before do not count
+	if p := newProblems([]string{"a", "b"}, []string{"a", "b"}); len(p) != 0 {
+		t.Fatalf("unexpected problems %#v", p)
+	}
+}
@@ -0,0 +1,104 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package factoids
+
+import (
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sirc"
+)
+
+// the accounts that can modify every factoid, even the locked ones
+var superadmins = map[string]struct{}{}
+
+func isSuperadmin(user string) bool {
+	_, ok := superadmins[user]
+	return ok
+}
+
+// the state lock needs to be held by the caller
+func isLocked(key string) bool {
+	_, ok := s.Locked[key]
+	return ok
+}
+
+// canModify checks whether the user is allowed to modify the factoid, which is
+// only restricted if the factoid is locked, in which case only the owner and
+// the superadmins can modify it, notices the user if not allowed
+// the state lock needs to be held by the caller
+func canModify(c *sirc.IConn, m *irc.Message, user, key string) bool {
+	if reason := modifyDenied(user, key); reason != "" {
+		c.Notice(m, reason)
+		return false
+	}
+
+	return true
+}
+
+// modifyDenied returns the reason the user is not allowed to modify the
+// factoid or an empty string if the user is allowed to
+// the state lock needs to be held by the caller
+func modifyDenied(user, key string) string {
+	if !isLocked(key) {
+		return ""
+	}
+
+	owner := s.Owners[key]
+	if (owner != "" && user == owner) || isSuperadmin(user) {
+		return ""
+	}
+
+	if owner == "" {
+		return "The factoid " + key + " is locked, only superadmins can modify it"
+	}
+	return "The factoid " + key + " is locked, only its owner " + owner + " or superadmins can modify it"
+}
+
+// lockDenied returns the reason the user is not allowed to lock or unlock the
+// factoid or an empty string if the user is allowed to, factoids from before
+// ownership was recorded stay unowned, only the superadmins can lock them,
+// locking is not a way to claim them
+// the state lock needs to be held by the caller
+func lockDenied(user, key string) string {
+	if isSuperadmin(user) {
+		return ""
+	}
+
+	owner := s.Owners[key]
+	if owner == "" {
+		return key + " has no owner, only superadmins can lock or unlock it"
+	}
+	if user != owner {
+		return "Only the owner of " + key + " (" + owner + ") or superadmins can lock or unlock it"
+	}
+	return ""
+}
+
+// moveOwnership moves the ownership and locked status of a renamed factoid
+// the state lock needs to be held by the caller
+func moveOwnership(oldkey, newkey string) {
+	if owner, ok := s.Owners[oldkey]; ok {
+		s.Owners[newkey] = owner
+		delete(s.Owners, oldkey)
+	}
+	if _, ok := s.Locked[oldkey]; ok {
+		s.Locked[newkey] = struct{}{}
+		delete(s.Locked, oldkey)
+	}
+}
@@ -0,0 +1,64 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package factoids
+
+import (
+	"testing"
+)
+
+func TestModifyDenied(t *testing.T) {
+	s = &st{
+		Owners: map[string]string{"boot": "kay", "locked": "kay"},
+		Locked: map[string]struct{}{"locked": {}, "unowned": {}},
+	}
+	superadmins = map[string]struct{}{"lennart": {}}
+	defer (func() { s, superadmins = nil, map[string]struct{}{} })()
+
+	tests := []struct {
+		user, key string
+		modify    bool
+		lock      bool
+	}{
+		// not locked, every admin can modify it, only the owner can lock it
+		{"kay", "boot", true, true},
+		{"armin", "boot", true, false},
+		{"lennart", "boot", true, true},
+		// locked, only the owner and the superadmins
+		{"kay", "locked", true, true},
+		{"armin", "locked", false, false},
+		{"lennart", "locked", true, true},
+		// locked without an owner, only the superadmins, an empty user is
+		// not the owner of the unowned ones
+		{"armin", "unowned", false, false},
+		{"", "unowned", false, false},
+		{"lennart", "unowned", true, true},
+		// unowned and not locked, locking is not a way to claim it
+		{"armin", "new", true, false},
+		{"lennart", "new", true, true},
+	}
+	for _, tt := range tests {
+		if modify := modifyDenied(tt.user, tt.key) == ""; modify != tt.modify {
+			t.Errorf("%s %s: expected modify %v", tt.user, tt.key, tt.modify)
+		}
+		if lock := lockDenied(tt.user, tt.key) == ""; lock != tt.lock {
+			t.Errorf("%s %s: expected lock %v", tt.user, tt.key, tt.lock)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package factoids
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sd-bot/commands"
+	"github.com/sztanpet/sd-bot/modules"
+	"github.com/sztanpet/sirc"
+	"golang.org/x/net/context"
+)
+
+// Module is the factoids module, main registers it
+var Module modules.Module = module{}
+
+type module struct{}
+
+func (module) Name() string { return "factoids" }
+
+func (module) Init(ctx context.Context) context.Context { return Init(ctx) }
+
+func (module) HandleIRC(c *sirc.IConn, m *irc.Message, tags map[string]string) bool {
+	if m.Command != irc.PRIVMSG {
+		return false
+	}
+
+	return Handle(c, m)
+}
+
+func (module) Commands() []commands.Command { return factoidCommands() }
+
+func (module) Routes() []modules.Route {
+	return []modules.Route{
+		{Path: pagePath, Handler: func(w http.ResponseWriter, r *http.Request) {
+			tpl.render()
+			tpl.execute(w)
+		}},
+		{Path: path.Join(pagePath, "proposals"), Handler: proposalHandler},
+	}
+}
+
+// Shutdown saves the state, the usage times are not saved otherwise
+func (module) Shutdown(ctx context.Context) error {
+	return state.Save()
+}
@@ -0,0 +1,241 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package factoids
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sd-bot/audit"
+	"github.com/sztanpet/sd-bot/commands"
+	"github.com/sztanpet/sirc"
+)
+
+// the number of pending proposals a single user can have
+const maxProposalsPerUser = 5
+
+type proposal struct {
+	ID   int
+	Key  string
+	Text string
+	User string // the account of the proposer
+	Nick string
+	Time time.Time
+}
+
+type proposalSlice []proposal
+
+func (p proposalSlice) Len() int           { return len(p) }
+func (p proposalSlice) Less(i, j int) bool { return p[i].ID < p[j].ID }
+func (p proposalSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+var (
+	proposeRE = regexp.MustCompile(`^([a-zA-Z0-9-.]+)\s+(.+)$`)
+	// NotifyAdmins is called with a message when a new proposal arrives, it is
+	// supposed to forward the message to the admins that are around
+	NotifyAdmins = func(c *sirc.IConn, msg string) {}
+	// the secret the approval form on the website has to be submitted with,
+	// without it proposals can only be approved from irc
+	approvalSecret string
+	// the path of the factoid page, the form redirects back to it
+	pagePath string
+)
+
+// handlePropose queues the proposal for approval by the admins, user is the
+// account of the sender
+func handlePropose(c *sirc.IConn, m *irc.Message, user, args string) {
+	matches := proposeRE.FindStringSubmatch(args)
+	if len(matches) == 0 {
+		c.Notice(m, "Usage: !propose <factoid-trigger> <factoid-text>")
+		return
+	}
+
+	key := strings.ToLower(matches[1])
+	text := lineBreakReplacer.Replace(strings.TrimSpace(matches[2]))
+
+	state.Lock()
+	defer state.Unlock()
+
+	p, reason := queueProposal(user, m.Prefix.Name, key, text)
+	if reason != "" {
+		c.Notice(m, reason)
+		return
+	}
+
+	id := strconv.Itoa(p.ID)
+	c.Notice(m, "Thank you, your proposal has been queued as #", id)
+	NotifyAdmins(c, "New factoid proposal #"+id+" from "+p.Nick+" ("+user+") for "+key+
+		": "+inlineBreaks.Replace(text)+" -- use .approve "+id+" or .reject "+id)
+}
+
+// queueProposal adds the proposal, returns the reason if it was not added
+// the state lock needs to be held by the caller
+func queueProposal(user, nick, key, text string) (proposal, string) {
+	var pending int
+	for _, p := range s.Proposals {
+		if p.User == user {
+			pending++
+		}
+	}
+	if pending >= maxProposalsPerUser {
+		return proposal{}, "You have too many pending proposals, please wait for the admins to review them"
+	}
+	if _, ok := s.Aliases[key]; ok {
+		return proposal{}, key + " is an alias, propose a change to the factoid it points to instead"
+	}
+
+	s.NextProposal++
+	p := proposal{
+		ID:   s.NextProposal,
+		Key:  key,
+		Text: text,
+		User: user,
+		Nick: nick,
+		Time: time.Now(),
+	}
+	s.Proposals[p.ID] = p
+	state.Save(false)
+	tpl.invalidate()
+	return p, ""
+}
+
+// handleProposalAdmin handles .proposals, .approve <id> and .reject <id>
+func handleProposalAdmin(c *sirc.IConn, m *irc.Message, user, command, id string) string {
+	pid, err := strconv.Atoi(id)
+	if command != "proposals" && err != nil {
+		c.Notice(m, "Usage: .", command, " <proposal-id>")
+		return commands.Usage
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	if command == "proposals" {
+		proposals := sortProposals()
+		if len(proposals) == 0 {
+			c.Notice(m, "There are no pending proposals")
+		}
+		for _, p := range proposals {
+			c.Notice(m, "#", strconv.Itoa(p.ID), " from ", p.Nick, " (", p.User, ") for ", p.Key, ": ", inlineBreaks.Replace(p.Text))
+		}
+		return commands.OK
+	}
+
+	msg, outcome := resolveProposal(pid, user, command == "approve")
+	c.Notice(m, msg)
+	return outcome
+}
+
+// resolveProposal approves or rejects the proposal, approving it adds or
+// modifies the factoid with user being the owner if it is newly added
+// returns the message describing the outcome, and the outcome
+// the state lock needs to be held by the caller
+func resolveProposal(id int, user string, approve bool) (string, string) {
+	p, ok := s.Proposals[id]
+	if !ok {
+		return "No proposal with the given id", commands.NotFound
+	}
+
+	if !approve {
+		delete(s.Proposals, id)
+		state.Save(false)
+		tpl.invalidate()
+		return "Rejected proposal #" + strconv.Itoa(id), commands.OK
+	}
+
+	if _, ok := s.Aliases[p.Key]; ok {
+		return p.Key + " is an alias, please delete it first", commands.Refused
+	}
+	if reason := modifyDenied(user, p.Key); reason != "" {
+		return reason, commands.Denied
+	}
+
+	// approved on the website, nobody owns it
+	if _, ok := s.Factoids[p.Key]; !ok && user != "" {
+		s.Owners[p.Key] = user
+	}
+	s.Factoids[p.Key] = p.Text
+	delete(s.Proposals, id)
+	state.Save(false)
+	tpl.invalidate()
+
+	return "Approved proposal #" + strconv.Itoa(id) + ", " + p.Key + " added/modified successfully", commands.OK
+}
+
+// sortProposals returns the pending proposals, oldest first
+// the state lock needs to be held by the caller
+func sortProposals() []proposal {
+	ps := make([]proposal, 0, len(s.Proposals))
+	for _, p := range s.Proposals {
+		ps = append(ps, p)
+	}
+
+	sort.Sort(proposalSlice(ps))
+	return ps
+}
+
+// proposalHandler handles the approval form on the website
+func proposalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || approvalSecret == "" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("secret")), []byte(approvalSecret)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	action := r.FormValue("action")
+	if action != "approve" && action != "reject" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	state.Lock()
+	msg, outcome := resolveProposal(id, "", action == "approve")
+	state.Unlock()
+
+	audit.Log(audit.Entry{
+		Nick:    "website",
+		Remote:  r.RemoteAddr,
+		Command: action,
+		Args:    strconv.Itoa(id),
+		Result:  outcome,
+	})
+
+	if outcome != commands.OK {
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+
+	http.Redirect(w, r, pagePath+"#proposals", http.StatusSeeOther)
+}
@@ -0,0 +1,133 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package factoids
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sztanpet/sd-bot/commands"
+	"github.com/sztanpet/sd-bot/persist"
+)
+
+// testState sets up an empty state saved in a temporary directory, returns a
+// function that cleans up
+func testState(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "sd-bot-factoids")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = persist.New(filepath.Join(dir, "factoids.state"), &st{
+		Factoids:  map[string]string{},
+		Aliases:   map[string]string{},
+		Used:      map[string]time.Time{},
+		MaxLines:  map[string]int{},
+		Tags:      map[string][]string{},
+		Owners:    map[string]string{},
+		Locked:    map[string]struct{}{},
+		Proposals: map[int]proposal{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = state.Get().(*st)
+
+	return func() {
+		s, state = nil, nil
+		superadmins = map[string]struct{}{}
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestProposalLimit(t *testing.T) {
+	defer testState(t)()
+	s.Aliases["b"] = "boot"
+
+	for i := 0; i < maxProposalsPerUser; i++ {
+		if _, reason := queueProposal("kay", "Kay", "boot"+strconv.Itoa(i), "text"); reason != "" {
+			t.Fatalf("%d: unexpected reason %q", i, reason)
+		}
+	}
+	if _, reason := queueProposal("kay", "Kay2", "more", "text"); reason == "" {
+		t.Fatal("expected the limit to apply to the account, not the nick")
+	}
+	if _, reason := queueProposal("armin", "armin", "b", "text"); reason == "" {
+		t.Fatal("expected a proposal for an alias to be refused")
+	}
+	if p, reason := queueProposal("armin", "armin", "more", "text"); reason != "" || p.ID != maxProposalsPerUser+1 {
+		t.Fatalf("unexpected proposal %#v, reason %q", p, reason)
+	}
+}
+
+func TestResolveProposal(t *testing.T) {
+	defer testState(t)()
+	superadmins["lennart"] = struct{}{}
+	s.Factoids["locked"] = "old"
+	s.Owners["locked"] = "kay"
+	s.Locked["locked"] = struct{}{}
+
+	propose := func(key string) int {
+		p, reason := queueProposal("zbyszek", "zbyszek", key, "new")
+		if reason != "" {
+			t.Fatalf("unexpected reason %q", reason)
+		}
+		return p.ID
+	}
+
+	// onto a locked factoid, only the owner and the superadmins
+	id := propose("locked")
+	for _, user := range []string{"armin", ""} {
+		if msg, outcome := resolveProposal(id, user, true); outcome != commands.Denied {
+			t.Errorf("%q: expected denied, got %s: %s", user, outcome, msg)
+		}
+	}
+	if msg, outcome := resolveProposal(id, "kay", true); outcome != commands.OK || s.Factoids["locked"] != "new" {
+		t.Errorf("expected the owner to approve, got %s: %s", outcome, msg)
+	}
+
+	// the key became an alias since it was proposed
+	id = propose("b")
+	s.Aliases["b"] = "locked"
+	if msg, outcome := resolveProposal(id, "lennart", true); outcome != commands.Refused || s.Factoids["b"] != "" {
+		t.Errorf("expected refused, got %s: %s", outcome, msg)
+	}
+
+	// from the website, a new factoid gets no owner
+	id = propose("new")
+	if msg, outcome := resolveProposal(id, "", true); outcome != commands.OK || s.Factoids["new"] != "new" {
+		t.Errorf("expected the website to approve, got %s: %s", outcome, msg)
+	}
+	if owner, ok := s.Owners["new"]; ok {
+		t.Errorf("unexpected owner %q", owner)
+	}
+
+	if _, outcome := resolveProposal(id, "", true); outcome != commands.NotFound {
+		t.Errorf("expected the proposal to be gone, got %s", outcome)
+	}
+	id = propose("rejected")
+	if _, outcome := resolveProposal(id, "", false); outcome != commands.OK || len(s.Proposals) != 1 {
+		t.Errorf("expected the proposal to be rejected, got %s, proposals %v", outcome, s.Proposals)
+	}
+}
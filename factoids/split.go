@@ -0,0 +1,90 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package factoids
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// an irc line is 512 bytes including the prefix the server prepends, the
+	// command, the target and the CRLF, so leave plenty of room for those
+	maxLineLength = 400
+	// the number of lines a factoid is allowed to print if not set explicitly
+	defaultMaxLines = 3
+	// the upper limit an admin can set with .maxlines, so that the bot does
+	// not flood the channel
+	maxMaxLines = 10
+)
+
+// \n in the factoid text given on irc is an explicit line break, \\n is a
+// literal \n
+var lineBreakReplacer = strings.NewReplacer(`\\n`, `\n`, `\n`, "\n")
+
+// inlineBreaks escapes the line breaks again, for showing a text with line
+// breaks in a single irc line, a raw line break would end the irc message and
+// the rest would be sent as a command of its own
+var inlineBreaks = strings.NewReplacer("\r", "", "\n", `\n`)
+
+// splitLines splits the text at the explicit line breaks and then splits every
+// line that is longer than max bytes at word boundaries, empty lines are
+// dropped because they cannot be sent
+func splitLines(text string, max int) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		for len(line) > max {
+			pos := strings.LastIndex(line[:max+1], " ")
+			if pos <= 0 { // no space to split at, split at a rune boundary
+				pos = max
+				for pos > 0 && !utf8.RuneStart(line[pos]) {
+					pos--
+				}
+				// not valid utf-8, nothing to keep together
+				if pos == 0 {
+					pos = max
+				}
+			}
+
+			lines = append(lines, strings.TrimRight(line[:pos], " "))
+			line = strings.TrimLeft(line[pos:], " ")
+		}
+
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// limitLines truncates lines to at most max lines, marking the truncation
+func limitLines(lines []string, max int) []string {
+	if len(lines) <= max {
+		return lines
+	}
+
+	// the lines of the caller are not modified
+	ret := make([]string, max)
+	copy(ret, lines)
+	ret[max-1] += " ..."
+	return ret
+}
@@ -0,0 +1,62 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+
+package factoids
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitLines(t *testing.T) {
+	text := lineBreakReplacer.Replace(`first line\nsecond \\n line\n\nthird line is long`)
+	lines := splitLines(text, 10)
+	expected := []string{"first line", `second \n`, "line", "third line", "is long"}
+	if strings.Join(lines, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected lines %#v", lines)
+	}
+
+	// no spaces, has to split at rune boundaries
+	lines = splitLines(strings.Repeat("é", 6), 5)
+	if len(lines) != 3 || lines[0] != "éé" {
+		t.Fatalf("unexpected lines %#v", lines)
+	}
+
+	lines = limitLines(expected, 2)
+	if len(lines) != 2 || lines[1] != `second \n ...` {
+		t.Fatalf("unexpected lines %#v", lines)
+	}
+	if expected[1] != `second \n` {
+		t.Fatalf("limitLines modified the lines of the caller %#v", expected)
+	}
+
+	// continuation bytes only, there is no rune boundary to split at
+	lines = splitLines(strings.Repeat("\x80", 12), 5)
+	if len(lines) != 3 || len(lines[0]) != 5 || len(lines[2]) != 2 {
+		t.Fatalf("unexpected lines %#v", lines)
+	}
+}
+
+func TestInlineBreaks(t *testing.T) {
+	text := lineBreakReplacer.Replace(`foo\r\nPRIVMSG NickServ :drop\\n`)
+	if got := inlineBreaks.Replace(text); strings.ContainsAny(got, "\r\n") || got != `foo\r\nPRIVMSG NickServ :drop\n` {
+		t.Fatalf("unexpected line %q", got)
+	}
+}
@@ -0,0 +1,128 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package factoids
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sirc"
+)
+
+// addTag tags the factoid, returns false if it was already tagged
+// the state lock needs to be held by the caller
+func addTag(s *st, key, tag string) bool {
+	tags := s.Tags[key]
+	pos := sort.SearchStrings(tags, tag)
+	if pos < len(tags) && tags[pos] == tag {
+		return false
+	}
+
+	tags = append(tags, "")
+	copy(tags[pos+1:], tags[pos:])
+	tags[pos] = tag
+	s.Tags[key] = tags
+	return true
+}
+
+// delTag removes the tag from the factoid, returns false if it was not tagged
+// the state lock needs to be held by the caller
+func delTag(s *st, key, tag string) bool {
+	tags := s.Tags[key]
+	pos := sort.SearchStrings(tags, tag)
+	if pos == len(tags) || tags[pos] != tag {
+		return false
+	}
+
+	tags = append(tags[:pos], tags[pos+1:]...)
+	if len(tags) == 0 {
+		delete(s.Tags, key)
+	} else {
+		s.Tags[key] = tags
+	}
+	return true
+}
+
+// tagNames returns every tag in use, sorted
+// the state lock needs to be held by the caller
+func tagNames(s *st) []string {
+	seen := map[string]struct{}{}
+	var ret []string
+	for _, tags := range s.Tags {
+		for _, tag := range tags {
+			if _, ok := seen[tag]; !ok {
+				seen[tag] = struct{}{}
+				ret = append(ret, tag)
+			}
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// taggedFactoids returns the sorted keys of the factoids with the given tag
+// the state lock needs to be held by the caller
+func taggedFactoids(s *st, tag string) []string {
+	var ret []string
+	for key, tags := range s.Tags {
+		pos := sort.SearchStrings(tags, tag)
+		if pos < len(tags) && tags[pos] == tag {
+			ret = append(ret, key)
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// handleTags handles !tags and !tag <name>, an empty tag lists the tags
+// the state lock needs to be held by the caller
+func handleTags(c *sirc.IConn, m *irc.Message, tag string) {
+	var usedkey, text string
+	if tag == "" {
+		usedkey = "!tags"
+		tags := tagNames(s)
+		if len(tags) == 0 {
+			text = "There are no tags"
+		} else {
+			text = "Tags: " + strings.Join(tags, ", ")
+		}
+	} else {
+		keys := taggedFactoids(s, tag)
+		if len(keys) == 0 {
+			// the usage times are saved, the unknown tags share one so
+			// that the channel cannot grow the state
+			usedkey = "!tag"
+			text = "No factoids tagged " + tag
+		} else {
+			usedkey = "!tag " + tag
+			text = "Factoids tagged " + tag + ": !" + strings.Join(keys, ", !")
+		}
+	}
+	if factoidUsedRecently(usedkey) {
+		return
+	}
+
+	for _, line := range limitLines(splitLines(text, maxLineLength), defaultMaxLines) {
+		c.PrivMsg(m, line)
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"html/template"
 	"math/rand"
 	"net/http"
+	"path"
 	"sort"
 	"strings"
 	"sync"
 
 	"github.com/mvdan/xurls"
+	"github.com/sztanpet/sd-bot/commands"
 	"github.com/sztanpet/sd-bot/debug"
 )
 
@@ -20,6 +22,20 @@ type factoid struct {
 	Name    string
 	Text    string
 	Aliases []string
+	Tags    []string
+	Owner   string
+	Locked  bool
+}
+
+type page struct {
+	Factoids  []factoid
+	Tags      []string
+	Proposals []proposal
+	// whether proposals can be approved from the website
+	Approval     bool
+	ProposalPath string
+	// the help of every command of the bot
+	Commands []commands.Group
 }
 
 type factoidSlice []factoid
@@ -68,6 +84,9 @@ func (c *cache) init(tplPath string) {
 			return template.HTML(s)
 		},
 		"ircize": ircToHTML,
+		"linebreaks": func(s template.HTML) template.HTML {
+			return template.HTML(strings.Replace(string(s), "\n", "<br/>", -1))
+		},
 	})
 
 	tpl, err := c.t.ParseFiles(tplPath)
@@ -106,7 +125,7 @@ func (c *cache) render() {
 	c.mu.Unlock()
 }
 
-func (c *cache) sortFactoids() []factoid {
+func (c *cache) sortFactoids() *page {
 	state.Lock()
 	defer state.Unlock()
 
@@ -125,9 +144,19 @@ func (c *cache) sortFactoids() []factoid {
 			Name:    name,
 			Text:    text,
 			Aliases: a[name],
+			Tags:    s.Tags[name],
+			Owner:   s.Owners[name],
+			Locked:  isLocked(name),
 		})
 	}
 
 	sort.Sort(factoidSlice(fs))
-	return fs
+	return &page{
+		Factoids:     fs,
+		Tags:         tagNames(s),
+		Proposals:    sortProposals(),
+		Approval:     approvalSecret != "",
+		ProposalPath: path.Join(pagePath, "proposals"),
+		Commands:     commands.Groups(),
+	}
 }
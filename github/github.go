@@ -27,45 +27,76 @@ import (
 	"text/template"
 
 	"github.com/sorcix/irc"
+	"github.com/sztanpet/sd-bot/commands"
 	"github.com/sztanpet/sd-bot/config"
 	"github.com/sztanpet/sd-bot/debug"
+	"github.com/sztanpet/sd-bot/metrics"
+	"github.com/sztanpet/sd-bot/modules"
 	"github.com/sztanpet/sirc"
 	"golang.org/x/net/context"
 )
 
 const maxLines = 5
 
+var deliveries = metrics.NewCounter("sdbot_webhook_deliveries_total",
+	"The number of webhook deliveries by event and outcome (ok, error or ignored).", "event", "outcome")
+
 type gh struct {
 	cfg config.Github
 	irc *sirc.IConn
 	tpl *template.Template
 }
 
-func Init(ctx context.Context) context.Context {
-	t, _ := ctx.Value("maintemplate").(*template.Template)
-	cfg := config.FromContext(ctx).Github
-	gh := &gh{
-		cfg: cfg,
-		irc: sirc.FromContext(ctx),
-		tpl: template.Must(t.ParseFiles(cfg.TplPath)),
-	}
+// Module announces the events of the github webhook on irc, main registers it
+var Module modules.Module = &gh{}
 
-	http.HandleFunc(gh.cfg.HookPath, gh.handler)
+func (s *gh) Name() string { return "github" }
+
+func (s *gh) Init(ctx context.Context) context.Context {
+	t, _ := ctx.Value("maintemplate").(*template.Template)
+	s.cfg = config.FromContext(ctx).Github
+	s.irc = sirc.FromContext(ctx)
+	s.tpl = template.Must(t.ParseFiles(s.cfg.TplPath))
 	return ctx
 }
 
+func (s *gh) HandleIRC(c *sirc.IConn, m *irc.Message, tags map[string]string) bool {
+	return false
+}
+
+func (s *gh) Commands() []commands.Command { return nil }
+
+func (s *gh) Routes() []modules.Route {
+	return []modules.Route{{Path: s.cfg.HookPath, Handler: s.handler}}
+}
+
+func (s *gh) Shutdown(ctx context.Context) error { return nil }
+
 func (s *gh) handler(w http.ResponseWriter, r *http.Request) {
 	d.D("request", r)
-	switch r.Header.Get("X-Github-Event") {
+	event := r.Header.Get("X-Github-Event")
+	var err error
+	switch event {
 	case "push":
-		s.pushHandler(r)
+		err = s.pushHandler(r)
 	case "gollum":
-		s.wikiHandler(r)
+		err = s.wikiHandler(r)
 	case "pull_request":
-		s.prHandler(r)
+		err = s.prHandler(r)
 	case "issues":
-		s.issueHandler(r)
+		err = s.issueHandler(r)
+	default:
+		// anyone can send any event, every one would be a new series
+		deliveries.Inc("other", "ignored")
+		return
+	}
+
+	if err != nil {
+		deliveries.Inc(event, "error")
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
 	}
+	deliveries.Inc(event, "ok")
 }
 
 func handlePayload(r *http.Request, data interface{}) error {
@@ -78,7 +109,7 @@ func handlePayload(r *http.Request, data interface{}) error {
 	return json.Unmarshal([]byte(payload), &data)
 }
 
-func (s *gh) pushHandler(r *http.Request) {
+func (s *gh) pushHandler(r *http.Request) error {
 	var data struct {
 		Ref     string
 		Before  string
@@ -98,8 +129,8 @@ func (s *gh) pushHandler(r *http.Request) {
 
 	err := handlePayload(r, &data)
 	if err != nil {
-		d.P("Error unmarshaling json:", err)
-		return
+		d.Error("Error unmarshaling json", "err", err)
+		return err
 	}
 
 	pos := strings.LastIndex(data.Ref, "/") + 1
@@ -166,9 +197,10 @@ func (s *gh) pushHandler(r *http.Request) {
 	for _, line := range lines {
 		s.writeLine(line)
 	}
+	return nil
 }
 
-func (s *gh) prHandler(r *http.Request) {
+func (s *gh) prHandler(r *http.Request) error {
 	var data struct {
 		Action string
 		PR     struct {
@@ -182,12 +214,12 @@ func (s *gh) prHandler(r *http.Request) {
 
 	err := handlePayload(r, &data)
 	if err != nil {
-		d.P("Error unmarshaling json:", err)
-		return
+		d.Error("Error unmarshaling json", "err", err)
+		return err
 	}
 
 	if data.Action != "opened" {
-		return
+		return nil
 	}
 
 	b := bytes.NewBuffer(nil)
@@ -202,9 +234,10 @@ func (s *gh) prHandler(r *http.Request) {
 	})
 
 	s.writeLine(b.String())
+	return nil
 }
 
-func (s *gh) wikiHandler(r *http.Request) {
+func (s *gh) wikiHandler(r *http.Request) error {
 	var data struct {
 		Pages []struct {
 			Page   string `json:"page_name"`
@@ -219,8 +252,8 @@ func (s *gh) wikiHandler(r *http.Request) {
 
 	err := handlePayload(r, &data)
 	if err != nil {
-		d.P("Error unmarshaling json:", err)
-		return
+		d.Error("Error unmarshaling json", "err", err)
+		return err
 	}
 
 	lines := make([]string, 0, len(data.Pages))
@@ -251,9 +284,10 @@ func (s *gh) wikiHandler(r *http.Request) {
 	for _, line := range lines {
 		s.writeLine(line)
 	}
+	return nil
 }
 
-func (s *gh) issueHandler(r *http.Request) {
+func (s *gh) issueHandler(r *http.Request) error {
 	var data struct {
 		Action string
 		Issue  struct {
@@ -267,12 +301,12 @@ func (s *gh) issueHandler(r *http.Request) {
 
 	err := handlePayload(r, &data)
 	if err != nil {
-		d.P("Error unmarshaling json:", err)
-		return
+		d.Error("Error unmarshaling json", "err", err)
+		return err
 	}
 
 	if data.Action != "opened" {
-		return
+		return nil
 	}
 
 	b := bytes.NewBuffer(nil)
@@ -287,6 +321,7 @@ func (s *gh) issueHandler(r *http.Request) {
 	})
 
 	s.writeLine(b.String())
+	return nil
 }
 
 func (s *gh) writeLine(line string) {
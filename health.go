@@ -0,0 +1,156 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sztanpet/sd-bot/config"
+	"github.com/sztanpet/sd-bot/debug"
+	"github.com/sztanpet/sd-bot/persist"
+	"github.com/sztanpet/sd-bot/systemd"
+	"golang.org/x/net/context"
+)
+
+var started = time.Now()
+
+// how long after registering systemd is told that the bot is ready even if it
+// is not in every channel yet, an invite only channel or a ban would hold up
+// the start forever otherwise, less than the default TimeoutStartSec
+const readyTimeout = time.Minute
+
+var (
+	// set once the modules loaded their state, accessed atomically
+	loaded int32
+	// set once systemd was told that the bot is ready, accessed atomically
+	readySent int32
+)
+
+// setLoaded records that every state is loaded, called once the modules are
+// initialized
+func setLoaded(channels []string) {
+	atomic.StoreInt32(&loaded, 1)
+	notifyReady(channels)
+}
+
+func isLoaded() bool {
+	return atomic.LoadInt32(&loaded) == 1
+}
+
+// notifyReady tells systemd that the bot is ready once it is registered on the
+// irc server, has its state loaded and is in every channel of the config
+func notifyReady(channels []string) {
+	if !caps.isRegistered() || !isLoaded() || len(join.missing(channels)) > 0 {
+		return
+	}
+	sendReady()
+}
+
+// readyAnyway tells systemd that the bot is ready readyTimeout after
+// registering, even if it could not join every channel of the config
+func readyAnyway(channels []string) {
+	time.Sleep(readyTimeout)
+	if !caps.isRegistered() || !isLoaded() || atomic.LoadInt32(&readySent) == 1 {
+		return
+	}
+
+	if missing := join.missing(channels); len(missing) > 0 {
+		d.Warn("Could not join every channel in time, ready anyway", "missing", missing)
+	}
+	sendReady()
+}
+
+// sendReady sends READY=1 the first time it is called
+func sendReady() {
+	if !atomic.CompareAndSwapInt32(&readySent, 0, 1) {
+		return
+	}
+	if err := systemd.Ready(); err != nil {
+		d.Warn("Could not notify systemd", "err", err)
+	}
+}
+
+type readiness struct {
+	Ready  bool            `json:"ready"`
+	Checks map[string]bool `json:"checks"`
+	// the channels of the config the bot is not in
+	MissingChannels []string `json:"missingChannels,omitempty"`
+	StateFiles      []string `json:"stateFiles"`
+	// the state files that could not be saved the last time
+	FailedStateFiles []string `json:"failedStateFiles,omitempty"`
+	// seconds since the last message from the irc server, PONGs included
+	LastSeen float64 `json:"lastSeen"`
+}
+
+// handleHealthz answers as long as the process is able to serve requests
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &struct {
+		Status string  `json:"status"`
+		Uptime float64 `json:"uptime"`
+	}{
+		Status: "ok",
+		Uptime: time.Since(started).Seconds(),
+	})
+}
+
+// readyzHandler answers with 503 unless the bot is registered on the irc
+// server, in every channel of the config, has its state loaded and saved
+// without errors the last time and heard from the server recently
+func readyzHandler(ctx context.Context) http.HandlerFunc {
+	channels := config.FromContext(ctx).IRC.Channels
+	return func(w http.ResponseWriter, r *http.Request) {
+		since := live.since()
+		ret := &readiness{
+			Ready:            true,
+			Checks:           map[string]bool{},
+			MissingChannels:  join.missing(channels),
+			StateFiles:       persist.Paths(),
+			FailedStateFiles: persist.Failed(),
+			LastSeen:         since.Seconds(),
+		}
+
+		add := func(name string, ok bool) {
+			ret.Checks[name] = ok
+			ret.Ready = ret.Ready && ok
+		}
+		add("registered", caps.isRegistered())
+		add("channels", len(ret.MissingChannels) == 0)
+		add("state", isLoaded() && len(ret.FailedStateFiles) == 0)
+		add("ping", since < pingTimeout)
+
+		status := http.StatusOK
+		if !ret.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, ret)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		d.Error("Could not write the response", "err", err)
+	}
+}
@@ -1,143 +1,608 @@
 package main
 
 import (
-	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sorcix/irc"
+	"github.com/sztanpet/sd-bot/audit"
+	"github.com/sztanpet/sd-bot/commands"
 	"github.com/sztanpet/sd-bot/config"
 	"github.com/sztanpet/sd-bot/debug"
+	"github.com/sztanpet/sd-bot/dispatch"
 	"github.com/sztanpet/sd-bot/factoids"
-	"github.com/sztanpet/sd-bot/persist"
+	"github.com/sztanpet/sd-bot/metrics"
+	"github.com/sztanpet/sd-bot/modules"
+	"github.com/sztanpet/sd-bot/services"
+	"github.com/sztanpet/sd-bot/systemd"
+	"github.com/sztanpet/sd-bot/tlsproxy"
 	"github.com/sztanpet/sirc"
 	"golang.org/x/net/context"
 )
 
-var (
-	adminState *persist.State
-	admins     map[string]struct{}
-	adminRE    = regexp.MustCompile(`^\.(addadmin|deladmin|raw)\s+(.*)$`)
-)
-
 func initIRC(ctx context.Context) context.Context {
-	adminRE.Longest()
-
+	tcfg := config.FromContext(ctx)
 	var err error
-	adminState, err = persist.New("admins.state", &map[string]struct{}{
-		"sztanpet": struct{}{},
-	})
+	svc, err = services.New(tcfg.Nickserv.Services)
 	if err != nil {
-		d.F(err.Error())
+		d.F("Invalid services in the config, err: %v", err)
 	}
 
-	admins = *adminState.Get().(*map[string]struct{})
+	account := tcfg.Nickserv.Account
+	if account == "" {
+		account = tcfg.IRC.Nick
+	}
+	sasl.configure(tcfg.Nickserv.SASL, account, tcfg.Nickserv.Password)
+	if strings.EqualFold(tcfg.Nickserv.SASL, "external") && (!tcfg.IRC.TLS || tcfg.IRC.CertFile == "") {
+		d.Error("SASL EXTERNAL needs tls and a client certificate in the irc config")
+	}
+
+	initRoles(tcfg.Owners)
+	ac.init(time.Duration(tcfg.Nickserv.CacheTTL) * time.Second)
+	factoids.NotifyAdmins = notifyAdmins
+	registerHandlers(ctx)
 
-	tcfg := config.FromContext(ctx)
 	sirc.DebuggingEnabled = tcfg.Debug.Debug
+	// sirc gets proxied to see the messages it sends, tls or not
+	tlsproxy.Sent = countSent
+	tlsproxy.Received = rawTags.received
+	tlsproxy.Preamble = capLS
+	var addr string
+	if tcfg.IRC.TLS {
+		addr, err = tlsproxy.Listen(tcfg.IRC)
+		if err != nil {
+			d.F("Could not set up TLS, err: %v", err)
+		}
+	} else {
+		addr, err = tlsproxy.Relay(tcfg.IRC.Addr)
+		if err != nil {
+			d.F("Could not set up the connection, err: %v", err)
+		}
+	}
+
 	cfg := sirc.Config{
-		Addr:     tcfg.IRC.Addr,
+		Addr:     addr,
 		Nick:     tcfg.IRC.Nick,
 		Password: tcfg.IRC.Password,
 		RealName: "http://sd-bot.sztanpet.net/",
 	}
+	setStatus("Connecting to ", tcfg.IRC.Addr)
 	c := sirc.Init(cfg, func(c *sirc.IConn, m *irc.Message) bool {
 		return handleIRC(ctx, c, m)
 	})
+	go keepAlive(c)
+	systemd.Watchdog(live.alive)
 
 	return c.ToContext(ctx)
 }
 
+// events gets every message from the irc server, initIRC registers the
+// handlers in the order they need to see the messages in
+var events = &dispatch.Dispatcher{}
+
+var (
+	ircConnected = metrics.NewGauge("sdbot_irc_connected",
+		"Whether the bot is registered on the irc server.")
+	ircReconnects = metrics.NewCounter("sdbot_irc_reconnects_total",
+		"The number of times the bot registered again after losing the connection.")
+	messagesReceived = metrics.NewCounter("sdbot_irc_messages_received_total",
+		"The number of messages received from the irc server by command.", "command")
+	messagesSent = metrics.NewCounter("sdbot_irc_messages_sent_total",
+		"The number of messages sent to the irc server by command.", "command")
+
+	// registered once already, only accessed from the handlers
+	welcomed bool
+)
+
+// countSent counts the lines sirc sends to the server, called by tlsproxy
+func countSent(line []byte) {
+	if m := irc.ParseMessage(string(line)); m != nil {
+		messagesSent.Inc(m.Command)
+	}
+}
+
+func registerHandlers(ctx context.Context) {
+	events.Observe(func(c *sirc.IConn, m *irc.Message, tags map[string]string) {
+		live.seen()
+		if m.Command != "DISCONNECT" {
+			messagesReceived.Inc(m.Command)
+		}
+		handleConnection(ctx, c, m)
+	})
+	events.Observe(func(c *sirc.IConn, m *irc.Message, tags map[string]string) {
+		trackJoins(ctx, m)
+	}, irc.JOIN, irc.PART, irc.KICK)
+	events.Handle(func(c *sirc.IConn, m *irc.Message, tags map[string]string) bool {
+		return handleSASL(c, m)
+	})
+	events.Handle(handleIRCv3)
+	events.Observe(trackMembership, membershipCommands...)
+	events.Handle(handleServices, servicesCommands...)
+}
+
+// registerModules hands the messages to the commands and then to the enabled
+// modules, called once the modules are initialized
+func registerModules(ctx context.Context) {
+	registerCommands(ctx)
+	events.Handle(func(c *sirc.IConn, m *irc.Message, tags map[string]string) bool {
+		return handleCommand(c, m)
+	}, irc.PRIVMSG)
+	for _, mod := range modules.Enabled() {
+		events.Handle(mod.HandleIRC)
+	}
+}
+
 func handleIRC(ctx context.Context, c *sirc.IConn, m *irc.Message) bool {
-	if m.Command == irc.RPL_WELCOME {
-		cfg := config.FromContext(ctx)
+	m, tags := untag(m)
+	return events.Dispatch(c, m, tags)
+}
+
+// handleConnection follows the state of the connection, it joins the channels
+// once registered
+func handleConnection(ctx context.Context, c *sirc.IConn, m *irc.Message) {
+	switch m.Command {
+	case "DISCONNECT":
+		join.reset()
+		ircConnected.Set(0)
+		setStatus("Disconnected, reconnecting to ", config.FromContext(ctx).IRC.Addr)
+	case irc.RPL_WELCOME:
+		// >> :server 001 sd-bot :Welcome
+		ircConnected.Set(1)
+		if welcomed {
+			ircReconnects.Inc()
+		}
+		welcomed = true
+		go readyAnyway(config.FromContext(ctx).IRC.Channels)
+		if len(m.Params) > 0 {
+			ac.SetMe(m.Params[0])
+			setStatus("Registered as ", m.Params[0], ", joining the channels")
+		}
+		handleWelcome(ctx, c)
+	case "900": // RPL_LOGGEDIN, identified after registration, join if waiting
+		if caps.isRegistered() && joinChannels(ctx, c) {
+			d.P("Identified, joined the channels")
+		}
+	}
+}
+
+// quitIRC sends QUIT and waits for the server to close the connection, by
+// then every message queued before the QUIT has been sent
+func quitIRC(ctx context.Context, c *sirc.IConn, msg string) {
+	if c == nil || !caps.isRegistered() {
+		return
+	}
+
+	closed := make(chan struct{})
+	var once sync.Once
+	events.Observe(func(c *sirc.IConn, m *irc.Message, tags map[string]string) {
+		once.Do(func() { close(closed) })
+	}, "DISCONNECT", "ERROR")
+
+	c.Write(&irc.Message{
+		Command:  irc.QUIT,
+		Trailing: msg,
+	})
+
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		d.Warn("The irc server did not close the connection in time")
+	}
+}
+
+// handleWelcome identifies with NickServ if SASL did not succeed and joins the
+// channels, once identified if possible
+func handleWelcome(ctx context.Context, c *sirc.IConn) {
+	cfg := config.FromContext(ctx)
+	attempted, success := sasl.result()
+	if attempted && !success {
+		d.Warn("SASL authentication failed, falling back to identifying with NickServ")
+	} else if !attempted && sasl.configured() {
+		d.Warn("Could not use SASL, the server does not support it or registration finished too early, falling back to identifying with NickServ")
+	}
+
+	if !success && cfg.Nickserv.Password != "" {
+		sasl.mu.Lock()
+		account := sasl.account
+		sasl.mu.Unlock()
+		c.Write(svc.Identify(account, cfg.Nickserv.Password))
 		c.Write(&irc.Message{
-			Command:  irc.PRIVMSG,
-			Params:   []string{"NickServ"},
-			Trailing: "identify " + cfg.Nickserv.Password,
+			Command: irc.MODE,
+			Params:  []string{cfg.IRC.Nick, "+R"},
 		})
+
+		// wait for RPL_LOGGEDIN, but join eventually even if it never arrives
+		go (func() {
+			time.Sleep(identifyTimeout)
+			if joinChannels(ctx, c) {
+				d.Warn("Did not get identified in time, joined the channels anyway")
+			}
+		})()
+		return
+	}
+
+	if success {
 		c.Write(&irc.Message{
 			Command: irc.MODE,
 			Params:  []string{cfg.IRC.Nick, "+R"},
 		})
-		c.Write(&irc.Message{Command: irc.JOIN, Params: []string{"#systemd"}})
-		return false
 	}
+	joinChannels(ctx, c)
+}
 
-	if handleFreenode(c, m) {
-		return true
+// how long to wait for NickServ to identify us before joining anyway
+const identifyTimeout = 10 * time.Second
+
+type joinState struct {
+	mu     sync.Mutex
+	joined bool // whether the JOINs were sent
+	// the channels the server confirmed the bot is in, lowercase
+	channels map[string]struct{}
+}
+
+func (j *joinState) reset() {
+	j.mu.Lock()
+	j.joined = false
+	j.channels = map[string]struct{}{}
+	j.mu.Unlock()
+}
+
+// update records that the bot joined or left the channel, returns whether
+// the bot is in every one of the wanted channels
+func (j *joinState) update(channel string, in bool, wanted []string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.channels == nil {
+		j.channels = map[string]struct{}{}
+	}
+	if in {
+		j.channels[strings.ToLower(channel)] = struct{}{}
+	} else {
+		delete(j.channels, strings.ToLower(channel))
 	}
 
-	if m.Command != irc.PRIVMSG {
-		return false
+	return len(j.missingLocked(wanted)) == 0
+}
+
+// missing returns the wanted channels the bot is not in
+func (j *joinState) missing(wanted []string) []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.missingLocked(wanted)
+}
+
+func (j *joinState) missingLocked(wanted []string) []string {
+	var ret []string
+	for _, channel := range wanted {
+		if _, ok := j.channels[strings.ToLower(channel)]; !ok {
+			ret = append(ret, channel)
+		}
 	}
+	return ret
+}
 
-	if factoids.Handle(c, m) {
-		return true
+// trackJoins follows which channels the bot is in, systemd is told that the
+// bot is ready once it is in every channel of the config
+func trackJoins(ctx context.Context, m *irc.Message) {
+	var channel, nick string
+	switch m.Command {
+	case irc.KICK:
+		// >> :op!user@host KICK #channel nick :reason
+		if len(m.Params) < 2 {
+			return
+		}
+		channel, nick = m.Params[0], m.Params[1]
+	default:
+		// >> :nick!user@host JOIN #channel
+		if m.Prefix == nil {
+			return
+		}
+		channel, nick = m.Trailing, m.Prefix.Name
+		if len(m.Params) > 0 {
+			channel = m.Params[0]
+		}
 	}
 
-	if m.Trailing[0] == '.' {
-		go checkAdmin(c, m)
-		return true
+	if !ac.IsMe(nick) {
+		return
+	}
+
+	cfg := config.FromContext(ctx).IRC
+	if !join.update(channel, m.Command == irc.JOIN, cfg.Channels) {
+		setStatus("Connected to ", cfg.Addr, " as ", nick, ", not in every channel")
+		return
 	}
 
-	return false
+	setStatus("Connected to ", cfg.Addr, " as ", nick, ", joined ", strings.Join(cfg.Channels, " "))
+	notifyReady(cfg.Channels)
 }
 
-func checkAdmin(c *sirc.IConn, m *irc.Message) {
-	ch := make(chan string, 1)
-	if u, ok := ac.Get(m.Prefix.Name); ok {
-		ch <- u
-	} else {
-		lookupUsername(c, m, ch)
+var join = &joinState{}
+
+// joinChannels joins the configured channels if they were not joined yet since
+// connecting, returns whether it joined them
+func joinChannels(ctx context.Context, c *sirc.IConn) bool {
+	join.mu.Lock()
+	joined := join.joined
+	join.joined = true
+	join.mu.Unlock()
+	if joined {
+		return false
+	}
+
+	for _, channel := range config.FromContext(ctx).IRC.Channels {
+		c.Write(&irc.Message{Command: irc.JOIN, Params: []string{channel}})
+	}
+	return true
+}
+
+// withAccount resolves the account name of the sender of the message and
+// calls fn with it, fn is not called if the account could not be resolved
+func withAccount(c *sirc.IConn, m *irc.Message, fn func(user string)) {
+	nick := m.Prefix.Name
+	if _, ok := ac.Get(nick); !ok && caps.Has("account-tag") {
+		// the message would have had the account tag, the user is not
+		// logged in, no need to ask
+		return
 	}
 
 	go (func() {
-		user, ok := <-ch
-		if !ok { // channel got closed due to timeout
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+
+		if user, ok := lookups.Lookup(ctx, c, nick); ok {
+			fn(user)
+		}
+	})()
+}
+
+// handleCommand runs the command in the message, once the account of the
+// sender is known if the command needs it, the commands that need a
+// permission are recorded in the audit log with their outcome
+func handleCommand(c *sirc.IConn, m *irc.Message) bool {
+	cmd, args, ok := commands.Match(m.Trailing)
+	if !ok {
+		return false
+	}
+
+	if !cmd.NeedsAccount() {
+		cmd.Handle(c, m, args, "")
+		return true
+	}
+
+	withAccount(c, m, func(user string) {
+		if cmd.Permission == "" {
+			cmd.Handle(c, m, args, user)
 			return
 		}
 
-		adminState.Lock()
-		_, admin := admins[user]
-		adminState.Unlock()
-		if !admin {
+		if !isPrivileged(user) {
+			auditLog(m, user, "denied")
 			return
 		}
 
-		if factoids.HandleAdmin(c, m) {
+		if !hasPermission(user, cmd.Permission) {
+			c.Notice(m, "You do not have the permission to use ", cmd.String())
+			auditLog(m, user, "denied")
 			return
 		}
 
-		handleAdmin(c, m)
-	})()
+		auditLog(m, user, cmd.Handle(c, m, args, user))
+	})
+	return true
 }
 
-func handleAdmin(c *sirc.IConn, m *irc.Message) bool {
-	matches := adminRE.FindStringSubmatch(m.Trailing)
-	if len(matches) == 0 {
-		return false
+// auditLog records the administrative command in the audit log
+func auditLog(m *irc.Message, user, result string) {
+	e := audit.Entry{
+		Nick:    m.Prefix.Name,
+		Account: user,
+		Result:  result,
 	}
-	adminState.Lock()
-	// lifo defer order
-	defer adminState.Save()
-	defer adminState.Unlock()
-
-	user := strings.TrimSpace(matches[2])
-	switch matches[1] {
-	case "addadmin":
-		admins[user] = struct{}{}
-		c.Notice(m, "Added user successfully")
-	case "deladmin":
-		delete(admins, user)
-		c.Notice(m, "Removed user successfully")
+	if len(m.Params) > 0 {
+		e.Channel = m.Params[0]
+	}
+
+	fields := strings.SplitN(strings.TrimPrefix(m.Trailing, "."), " ", 2)
+	e.Command = fields[0]
+	if len(fields) > 1 {
+		e.Args = strings.TrimSpace(fields[1])
+	}
+
+	audit.Log(e)
+}
+
+// notifyAdmins sends a notice to everyone we know the nick of that can
+// administer factoids
+func notifyAdmins(c *sirc.IConn, msg string) {
+	// a line break would end the message, the rest would be a command
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	for nick, user := range ac.Accounts() {
+		if hasPermission(user, permFactoids) {
+			c.Write(&irc.Message{
+				Command:  irc.NOTICE,
+				Params:   []string{nick},
+				Trailing: msg,
+			})
+		}
+	}
+}
+
+// registerCommands registers the commands of the bot itself
+func registerCommands(ctx context.Context) {
+	admin := func(group, name, args, permission, description string) commands.Command {
+		return commands.Command{
+			Prefix:      commands.Admin,
+			Name:        name,
+			Args:        args,
+			Group:       group,
+			Permission:  permission,
+			Description: description,
+			Handle: func(c *sirc.IConn, m *irc.Message, args, user string) string {
+				return handleAdmin(ctx, c, m, user, name, args)
+			},
+		}
+	}
+
+	const (
+		rolesGroup = "Administer roles"
+		announce   = "Announcements"
+		auditGroup = "Audit log"
+		raw        = "Raw irc protocol access"
+	)
+	commands.Register(
+		commands.Command{
+			Prefix:      commands.Public,
+			Name:        "help",
+			Args:        "[command]",
+			Group:       "Help",
+			Description: "Lists the commands, or shows the usage and the description of the given command.",
+			Handle: func(c *sirc.IConn, m *irc.Message, args, user string) string {
+				for _, line := range commands.Help(args) {
+					c.Notice(m, line)
+				}
+				return commands.OK
+			},
+		},
+		admin(rolesGroup, "grant", "<username> <role>", permRoles,
+			"Grants the role to the user identified by the given services account name (\"sztanpet\").\n"+
+				"The roles are: owner (every command), admin (every command except managing the roles), "+
+				"factoid-editor (the factoid commands) and announcer (.announce).\n"+
+				"Only owners can grant or revoke roles."),
+		admin(rolesGroup, "revoke", "<username> <role>", permRoles,
+			"Revokes the role from the user with the given username."),
+		admin(rolesGroup, "roles", "[username]", permRoles,
+			"Lists the roles of the given user, or every role with the users that have it."),
+		admin(rolesGroup, "addadmin", "<username>", permRoles,
+			"Same as .grant <username> admin"),
+		admin(rolesGroup, "deladmin", "<username>", permRoles,
+			"Same as .revoke <username> admin"),
+		admin(announce, "announce", "<message>", permAnnounce,
+			"Sends the message to every channel the bot is configured for."),
+		admin(auditGroup, "audit", "[count]", permAudit,
+			"Shows the last count (10 by default, at most 50) administrative commands with who issued them and the outcome."),
+		admin(raw, "raw", "<irc-protocol>", permRaw,
+			"Send everything after the command as-is to the IRC server.\n"+
+				"Example: \".raw PRIVMSG #systemd :needs the colons so that space-separated things are not seen as arguments\""),
+	)
+}
+
+// handleAdmin handles the commands of the bot itself, returns the outcome
+func handleAdmin(ctx context.Context, c *sirc.IConn, m *irc.Message, user, command, args string) string {
+	switch command {
+	case "addadmin", "deladmin":
+		msg, outcome := changeRole(user, command == "addadmin", args, roleAdmin)
+		c.Notice(m, msg)
+		return outcome
+	case "grant":
+		fallthrough
+	case "revoke":
+		fields := strings.Fields(args)
+		if len(fields) != 2 {
+			c.Notice(m, "Usage: .", command, " <username> <role>")
+			return commands.Usage
+		}
+		msg, outcome := changeRole(user, command == "grant", fields[0], fields[1])
+		c.Notice(m, msg)
+		return outcome
+	case "roles":
+		listRoles(c, m, args)
+	case "audit":
+		n := 10
+		if args != "" {
+			n, _ = strconv.Atoi(args)
+		}
+		if n <= 0 || n > 50 {
+			c.Notice(m, "Usage: .audit [1-50]")
+			return commands.Usage
+		}
+		for _, e := range audit.Recent(n) {
+			c.Notice(m, e.String())
+		}
 	case "raw":
-		nm := irc.ParseMessage(matches[2])
+		nm := irc.ParseMessage(args)
 		if nm == nil {
 			c.Notice(m, "Could not parse, are you sure you know the irc protocol?")
+			return commands.Usage
+		}
+		go c.Write(nm)
+	case "announce":
+		if args == "" {
+			c.Notice(m, "Usage: .announce <message>")
+			return commands.Usage
+		}
+		for _, channel := range config.FromContext(ctx).IRC.Channels {
+			c.Write(&irc.Message{
+				Command:  irc.PRIVMSG,
+				Params:   []string{channel},
+				Trailing: args,
+			})
+		}
+	}
+	return commands.OK
+}
+
+// changeRole grants or revokes the role of target, the owner role can only be
+// handed out or taken away by owners and the last owner cannot be removed,
+// returns the message for the user and the outcome
+func changeRole(user string, grant bool, target, role string) (string, string) {
+	if target == "" || !isRole(role) {
+		return "Unknown user or role, the roles are: " + strings.Join(roleNames(), ", "), commands.Usage
+	}
+
+	roleState.Lock()
+	// lifo defer order
+	defer roleState.Save()
+	defer roleState.Unlock()
+
+	if role == roleOwner && !hasRole(user, roleOwner) {
+		return "Only owners can grant or revoke the owner role", commands.Denied
+	}
+
+	if grant {
+		if !grantRole(target, role) {
+			return target + " already has the role " + role, commands.Unchanged
+		}
+		return "Granted " + role + " to " + target + " successfully", commands.OK
+	}
+
+	if role == roleOwner && isOwner(target) {
+		return target + " is an owner in the config, the role cannot be revoked", commands.Refused
+	}
+	if role == roleOwner && hasRole(target, roleOwner) && len(usersWithRole(roleOwner)) == 1 {
+		return "Cannot revoke the role of the last owner", commands.Refused
+	}
+	if !revokeRole(target, role) {
+		return target + " does not have the role " + role, commands.Unchanged
+	}
+	return "Revoked " + role + " from " + target + " successfully", commands.OK
+}
+
+// listRoles lists the roles of the given user, or every role with the users
+// that have them if user is empty
+func listRoles(c *sirc.IConn, m *irc.Message, user string) {
+	roleState.Lock()
+	defer roleState.Unlock()
+
+	if user != "" {
+		r := roles[user]
+		if isOwner(user) && !hasGrantedRole(user, roleOwner) {
+			r = append([]string{roleOwner}, r...)
+		}
+		if len(r) > 0 {
+			c.Notice(m, user, " has the roles: ", strings.Join(r, ", "))
 		} else {
-			go c.Write(nm)
+			c.Notice(m, user, " has no roles")
 		}
+		return
 	}
 
-	return true
+	for _, role := range roleNames() {
+		if users := usersWithRole(role); len(users) > 0 {
+			c.Notice(m, role, ": ", strings.Join(users, ", "))
+		}
+	}
 }
@@ -0,0 +1,330 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sd-bot/debug"
+	"github.com/sztanpet/sirc"
+)
+
+// the capabilities we request if the server supports them, all of them are
+// about knowing the accounts of users without having to WHOIS them
+var wantedCaps = []string{
+	"account-notify", // ACCOUNT message on login/logout
+	"extended-join",  // JOIN includes the account
+	"account-tag",    // every message includes the account as a tag
+	"multi-prefix",   // every channel prefix of a user in NAMES/WHO
+}
+
+type capState struct {
+	mu         sync.Mutex
+	registered bool     // RPL_WELCOME arrived
+	ls         []string // the caps the server supports, accumulated from CAP LS
+	enabled    map[string]struct{}
+}
+
+func (cs *capState) reset() {
+	cs.mu.Lock()
+	cs.registered = false
+	cs.ls = nil
+	cs.enabled = map[string]struct{}{}
+	cs.mu.Unlock()
+}
+
+func (cs *capState) isRegistered() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.registered
+}
+
+// Has returns whether the capability got acknowledged by the server
+func (cs *capState) Has(cp string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	_, ok := cs.enabled[cp]
+	return ok
+}
+
+var caps = &capState{enabled: map[string]struct{}{}}
+
+// capLS starts the capability negotiation, tlsproxy sends it before the NICK
+// and USER of sirc, so the server holds the registration until CAP END, which
+// is what makes SASL possible, the server answers with the list of its
+// capabilities, out of which handleIRCv3 requests the wanted ones
+var capLS = []byte("CAP LS 302\r\n")
+
+// endCaps ends the capability negotiation, only needed before registration
+func endCaps(c *sirc.IConn) {
+	caps.mu.Lock()
+	registered := caps.registered
+	caps.mu.Unlock()
+	if registered {
+		return
+	}
+
+	c.Write(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"END"},
+	})
+}
+
+// the number of tagged lines remembered until the handlers get them
+const maxPendingTags = 64
+
+// tagQueue remembers the tagged lines received from the server as they were,
+// the irc library upper-cases everything before the first space, the tags
+// included, so the account names would be upper-cased too, and re-serializing
+// the parsed message would cut long lines at 510 bytes, the tags not counted
+type tagQueue struct {
+	mu      sync.Mutex
+	pending []string
+}
+
+var rawTags = &tagQueue{}
+
+// received is called by tlsproxy with every line before sirc gets it
+func (q *tagQueue) received(line []byte) {
+	if len(line) == 0 || line[0] != '@' || bytes.IndexByte(line, ' ') < 0 {
+		return
+	}
+
+	q.mu.Lock()
+	q.pending = append(q.pending, string(line))
+	if len(q.pending) > maxPendingTags {
+		q.pending = q.pending[len(q.pending)-maxPendingTags:]
+	}
+	q.mu.Unlock()
+}
+
+// original returns the line the message with the upper-cased tags was parsed
+// from, the lines arrive in the same order as the messages, the ones before
+// the match were not handed to the handlers by sirc
+func (q *tagQueue) original(upper string) (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, line := range q.pending {
+		if strings.ToUpper(line[:strings.IndexByte(line, ' ')]) == upper {
+			q.pending = q.pending[i+1:]
+			return line, true
+		}
+	}
+	return "", false
+}
+
+// untag splits off the IRCv3 message tags from the message, the irc library
+// does not know about them and parses "@tags :prefix COMMAND" as a command
+// named after the tags, so the original line is taken from rawTags and the
+// part after the tags is parsed again
+func untag(m *irc.Message) (*irc.Message, map[string]string) {
+	if !strings.HasPrefix(m.Command, "@") {
+		return m, nil
+	}
+
+	line, ok := rawTags.original(m.Command)
+	if !ok {
+		// better no tags than wrong ones, the account would not match
+		d.Warn("The original tags of the message are unknown", "tags", m.Command)
+		line = m.String()
+	}
+
+	pos := strings.IndexByte(line, ' ')
+	if pos < 0 {
+		return m, nil
+	}
+	nm := irc.ParseMessage(line[pos+1:])
+	if nm == nil {
+		return m, nil
+	}
+
+	if !ok {
+		return nm, map[string]string{}
+	}
+	return nm, parseTags(line[1:pos])
+}
+
+var tagValueReplacer = strings.NewReplacer(`\:`, ";", `\s`, " ", `\\`, `\`, `\r`, "\r", `\n`, "\n")
+
+// parseTags parses the "key=value;key2=value2" message tag format
+func parseTags(s string) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(s, ";") {
+		if tag == "" {
+			continue
+		}
+
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 1 {
+			tags[kv[0]] = ""
+		} else {
+			tags[kv[0]] = tagValueReplacer.Replace(kv[1])
+		}
+	}
+
+	return tags
+}
+
+// handleIRCv3 handles the capability negotiation and keeps the admin cache up
+// to date with the accounts the server tells us about
+func handleIRCv3(c *sirc.IConn, m *irc.Message, tags map[string]string) bool {
+	switch m.Command {
+	case "DISCONNECT":
+		caps.reset()
+		sasl.reset()
+		return false
+
+	case irc.RPL_WELCOME:
+		caps.mu.Lock()
+		caps.registered = true
+		caps.mu.Unlock()
+		return false
+
+	case "CAP":
+		// >> :server CAP * LS * :account-notify extended-join
+		// >> :server CAP sd-bot LS :multi-prefix sasl
+		// >> :server CAP sd-bot ACK :account-notify extended-join
+		if len(m.Params) < 2 {
+			return true
+		}
+
+		switch m.Params[1] {
+		case "LS":
+			caps.mu.Lock()
+			caps.ls = append(caps.ls, strings.Fields(m.Trailing)...)
+			more := len(m.Params) > 2 && m.Params[2] == "*"
+			ls := caps.ls
+			caps.mu.Unlock()
+			if !more {
+				reqCaps(c, ls)
+			}
+		case "ACK":
+			caps.mu.Lock()
+			for _, cp := range strings.Fields(m.Trailing) {
+				// -cap means it got disabled
+				if strings.HasPrefix(cp, "-") {
+					delete(caps.enabled, cp[1:])
+				} else {
+					caps.enabled[cp] = struct{}{}
+				}
+			}
+			caps.mu.Unlock()
+			d.P("Enabled capabilities", m.Trailing)
+
+			if caps.Has("sasl") && !sasl.started() {
+				startSASL(c)
+			} else {
+				endCaps(c)
+			}
+		case "NAK":
+			d.Warn("The server refused the capabilities", "caps", m.Trailing)
+			endCaps(c)
+		}
+		return true
+
+	case "ACCOUNT":
+		// >> :nick!user@host ACCOUNT accountname
+		// >> :nick!user@host ACCOUNT *
+		if m.Prefix == nil {
+			return false
+		}
+		account := m.Trailing
+		if len(m.Params) > 0 {
+			account = m.Params[0]
+		}
+		if account == "*" || account == "" { // logged out
+			ac.Del(m.Prefix.Name)
+		} else {
+			ac.Add(m.Prefix.Name, account)
+		}
+		lookups.forget(m.Prefix.Name)
+		return false
+
+	case irc.JOIN:
+		// >> :nick!user@host JOIN #channel accountname :realname
+		if m.Prefix == nil || !caps.Has("extended-join") || len(m.Params) < 2 {
+			return false
+		}
+		if m.Params[1] == "*" {
+			ac.Del(m.Prefix.Name)
+		} else {
+			ac.Add(m.Prefix.Name, m.Params[1])
+		}
+		return false
+	}
+
+	if m.Prefix != nil && caps.Has("account-tag") {
+		// the tag is missing if the user is not logged in
+		if account, ok := tags["account"]; ok {
+			ac.Add(m.Prefix.Name, account)
+		} else if m.Command == irc.PRIVMSG {
+			ac.Del(m.Prefix.Name)
+		}
+	}
+
+	return false
+}
+
+// reqCaps requests the wanted capabilities out of the ones in ls
+func reqCaps(c *sirc.IConn, ls []string) {
+	// CAP 302 LS may include values, like sasl=PLAIN,EXTERNAL
+	available := map[string]string{}
+	for _, cp := range ls {
+		kv := strings.SplitN(cp, "=", 2)
+		if len(kv) == 2 {
+			available[kv[0]] = kv[1]
+		} else {
+			available[kv[0]] = ""
+		}
+	}
+
+	var req []string
+	for _, cp := range wantedCaps {
+		if _, ok := available[cp]; ok {
+			req = append(req, cp)
+		}
+	}
+
+	caps.mu.Lock()
+	registered := caps.registered
+	caps.mu.Unlock()
+	if mechs, ok := available["sasl"]; ok && !registered && sasl.configured() {
+		if sasl.supported(mechs) {
+			req = append(req, "sasl")
+		} else {
+			d.Warn("The server does not support the configured SASL mechanism", "mechanisms", mechs)
+		}
+	}
+
+	if len(req) == 0 {
+		d.Warn("The server supports none of the wanted capabilities, falling back to WHOIS")
+		endCaps(c)
+		return
+	}
+
+	c.Write(&irc.Message{
+		Command:  "CAP",
+		Params:   []string{"REQ"},
+		Trailing: strings.Join(req, " "),
+	})
+}
@@ -0,0 +1,94 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestUntag(t *testing.T) {
+	rawTags = &tagQueue{}
+	lines := []string{
+		"@account=Lennart;time=2015-11-02T10:00:00.000Z :lennart!l@host PRIVMSG #systemd :.grant Kay admin",
+		":kay!k@host PRIVMSG #systemd :hello",
+		`@account=kay;msg=a\sb :kay!k@host PRIVMSG #systemd :!tags`,
+	}
+	want := []map[string]string{
+		{"account": "Lennart", "time": "2015-11-02T10:00:00.000Z"},
+		nil,
+		{"account": "kay", "msg": "a b"},
+	}
+
+	for _, line := range lines {
+		rawTags.received([]byte(line))
+	}
+	for i, line := range lines {
+		m, tags := untag(irc.ParseMessage(line))
+		if !reflect.DeepEqual(tags, want[i]) {
+			t.Errorf("%d: expected tags %v, got %v", i, want[i], tags)
+		}
+		if m.Command != irc.PRIVMSG || m.Prefix == nil || len(m.Params) != 1 || m.Params[0] != "#systemd" {
+			t.Errorf("%d: unexpected message %#v", i, m)
+		}
+	}
+
+	// the line is not cut at 510 bytes when the tags make it longer
+	text := ".add foo " + strings.Repeat("x", 400) + " END"
+	line := "@account=Lennart;time=2015-11-02T10:00:00.000Z;msgid=abcdefghijklmnop :lennart!l@host PRIVMSG #systemd :" + text
+	rawTags.received([]byte(line))
+	if m, _ := untag(irc.ParseMessage(line)); m.Trailing != text {
+		t.Errorf("expected the whole text, got %d bytes of %d", len(m.Trailing), len(text))
+	}
+
+	// a line never seen by the proxy gets no tags instead of wrong ones
+	m, tags := untag(irc.ParseMessage("@account=nobody :x!x@host PRIVMSG #systemd :hi"))
+	if len(tags) != 0 || m.Command != irc.PRIVMSG {
+		t.Errorf("unexpected tags %v of %#v", tags, m)
+	}
+}
+
+func TestCapAck(t *testing.T) {
+	caps.reset()
+	defer caps.reset()
+	// CAP END is only sent before registration
+	caps.registered = true
+
+	ack := func(list string) {
+		handleIRCv3(nil, &irc.Message{
+			Command:  "CAP",
+			Params:   []string{"sd-bot", "ACK"},
+			Trailing: list,
+		}, nil)
+	}
+	ack("account-notify extended-join")
+
+	// no prefix, nothing to do
+	handleIRCv3(nil, &irc.Message{Command: "ACCOUNT", Params: []string{"kay"}}, nil)
+	handleIRCv3(nil, &irc.Message{Command: irc.JOIN, Params: []string{"#systemd", "kay"}}, nil)
+
+	ack("-extended-join")
+	if !caps.Has("account-notify") || caps.Has("extended-join") {
+		t.Errorf("unexpected capabilities %v", caps.enabled)
+	}
+}
@@ -0,0 +1,81 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sd-bot/debug"
+	"github.com/sztanpet/sd-bot/systemd"
+	"github.com/sztanpet/sirc"
+)
+
+const (
+	// the server is pinged if nothing arrived from it for this long
+	pingInterval = time.Minute
+	// the connection is considered dead if nothing arrived for this long
+	pingTimeout = 3 * pingInterval
+)
+
+// liveness tracks when the last message arrived from the irc server
+type liveness struct {
+	mu       sync.Mutex
+	lastSeen time.Time
+}
+
+func (l *liveness) seen() {
+	l.mu.Lock()
+	l.lastSeen = time.Now()
+	l.mu.Unlock()
+}
+
+func (l *liveness) since() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Since(l.lastSeen)
+}
+
+// alive returns whether the bot is registered and heard from the server
+// recently
+func (l *liveness) alive() bool {
+	return caps.isRegistered() && l.since() < pingTimeout
+}
+
+var live = &liveness{}
+
+// keepAlive pings the server when it was quiet for a while, so that a dead
+// connection is noticed even if nobody talks
+func keepAlive(c *sirc.IConn) {
+	for range time.Tick(pingInterval) {
+		if caps.isRegistered() && live.since() >= pingInterval {
+			c.Write(&irc.Message{Command: irc.PING, Trailing: "sd-bot"})
+		}
+	}
+}
+
+// setStatus sets the status line systemctl status shows
+func setStatus(status ...string) {
+	if err := systemd.Status(strings.Join(status, "")); err != nil {
+		d.Warn("Could not notify systemd", "err", err)
+	}
+}
@@ -20,16 +20,25 @@
 package main
 
 import (
+	"crypto/tls"
 	"html"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"os"
 	"strings"
 	"text/template"
 	"time"
 
+	"github.com/sztanpet/sd-bot/audit"
 	"github.com/sztanpet/sd-bot/config"
 	"github.com/sztanpet/sd-bot/debug"
 	"github.com/sztanpet/sd-bot/factoids"
 	"github.com/sztanpet/sd-bot/github"
+	"github.com/sztanpet/sd-bot/metrics"
+	"github.com/sztanpet/sd-bot/modules"
+	"github.com/sztanpet/sd-bot/systemd"
+	"github.com/sztanpet/sd-bot/web"
 	"golang.org/x/net/context"
 )
 
@@ -38,14 +47,146 @@ func main() {
 	ctx := context.Background()
 	ctx = config.Init(ctx)
 	ctx = d.Init(ctx)
+	ctx = audit.Init(ctx)
 	ctx = initRootTemplate(ctx)
 	ctx = initIRC(ctx)
-	ctx = github.Init(ctx)
-	ctx = factoids.Init(ctx)
 
 	cfg := config.FromContext(ctx)
-	if err := http.ListenAndServe(cfg.Website.Addr, http.DefaultServeMux); err != nil {
-		d.F("ListenAndServe:", err)
+	modules.Register(github.Module, factoids.Module)
+	ctx = modules.Init(ctx, cfg.Modules.Disabled)
+	registerModules(ctx)
+	setLoaded(cfg.IRC.Channels)
+	web.Admin.Handle("/metrics", metrics.Handler())
+	web.Admin.HandleFunc("/healthz", handleHealthz)
+	web.Admin.HandleFunc("/readyz", readyzHandler(ctx))
+
+	trusted, err := web.ParseTrusted(cfg.Website.TrustedProxies)
+	if err != nil {
+		d.F("Could not parse the trusted proxies, err: %v", err)
+	}
+
+	// without an admin address the admin routes are public too
+	var public http.Handler = web.Fallback(web.Admin, web.Public)
+	if cfg.Website.AdminAddr != "" {
+		public = web.Public
+	}
+
+	srv := &http.Server{
+		Addr:    cfg.Website.Addr,
+		Handler: web.Forwarded(trusted, public),
+	}
+	servers := []*http.Server{srv}
+	if cfg.Website.CertFile != "" {
+		tlsSrv := tlsServer(cfg.Website, web.Forwarded(trusted, public))
+		if cfg.Website.Redirect {
+			srv.Handler = web.Forwarded(trusted, web.RedirectHTTPS(tlsSrv.Addr, public, cfg.Github.HookPath))
+		}
+		servers = append(servers, tlsSrv)
+	}
+	if addr := cfg.Website.AdminAddr; addr != "" {
+		registerPprof()
+		admin := &http.Server{
+			Addr:    addr,
+			Handler: web.Admin,
+		}
+		servers = append(servers, admin)
+		go serve(admin, adminListener(addr))
+	}
+
+	done := handleSignals(ctx, servers...)
+	ls := listeners(cfg.Website.Addr)
+	for _, l := range ls[1:] {
+		go serve(srv, l)
+	}
+	serve(srv, ls[0])
+	<-done
+}
+
+// listeners returns the sockets passed by systemd with socket activation, or
+// listens on addr if there are none
+func listeners(addr string) []net.Listener {
+	ls, err := systemd.Listeners()
+	if err != nil {
+		d.F("Could not use the sockets passed by systemd, err: %v", err)
+	}
+	if len(ls) > 0 {
+		return ls
+	}
+
+	if addr == "" {
+		addr = ":http"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		d.F("Listen: %v", err)
+	}
+	return []net.Listener{l}
+}
+
+// tlsServer starts serving h with TLS, the certificate is checked for changes
+// every minute
+func tlsServer(cfg config.Website, h http.Handler) *http.Server {
+	cert, err := web.LoadCertificate(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		d.F("Could not load the certificate, err: %v", err)
+	}
+	go cert.Watch(time.Minute)
+
+	addr := cfg.TLSAddr
+	if addr == "" {
+		addr = ":https"
+	}
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: h,
+		TLSConfig: &tls.Config{
+			GetCertificate: cert.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		},
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		d.F("Listen on the tls address: %v", err)
+	}
+	go serve(srv, tls.NewListener(l, srv.TLSConfig))
+	return srv
+}
+
+// adminListener listens on the unix socket if addr is a path, on the tcp
+// address otherwise
+func adminListener(addr string) net.Listener {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+		// left behind if the bot got killed
+		_ = os.Remove(addr)
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		d.F("Listen on the admin address: %v", err)
+	}
+	if network == "unix" {
+		if err := os.Chmod(addr, 0660); err != nil {
+			d.F("Chmod of the admin socket: %v", err)
+		}
+	}
+	return l
+}
+
+// registerPprof serves pprof on the admin address, never on the public one
+func registerPprof() {
+	web.Admin.HandlePrefix("/debug/pprof/", http.HandlerFunc(pprof.Index))
+	web.Admin.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	web.Admin.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	web.Admin.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	web.Admin.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+func serve(srv *http.Server, l net.Listener) {
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		d.F("Serve: %v", err)
 	}
 }
 
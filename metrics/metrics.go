@@ -0,0 +1,279 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package metrics collects counters, gauges and histograms and exposes them
+// in the Prometheus text format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+// every metric is created once, at package initialization, and is safe for
+// concurrent use
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets in seconds,
+// for durations from a few milliseconds to the account lookup timeout
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type series struct {
+	values []string // the values of the labels
+	value  float64  // counters and gauges
+
+	// histograms
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string // counter, gauge or histogram
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+var (
+	mu       sync.Mutex
+	families []*family
+)
+
+func newFamily(name, help, kind string, buckets []float64, labels []string) *family {
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, other := range families {
+		if other.name == name {
+			panic("metrics: " + name + " registered twice")
+		}
+	}
+	families = append(families, f)
+
+	return f
+}
+
+// get returns the series for the label values, the lock needs to be held by
+// the caller
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic("metrics: " + f.name + " expects " + strconv.Itoa(len(f.labels)) + " label values")
+	}
+
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter only ever goes up
+type Counter struct{ f *family }
+
+// NewCounter creates the counter, the label values have to be given in the
+// order of labels on every call
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newFamily(name, help, "counter", nil, labels)}
+}
+
+func (c *Counter) Inc(values ...string) { c.Add(1, values...) }
+
+func (c *Counter) Add(v float64, values ...string) {
+	c.f.mu.Lock()
+	c.f.get(values).value += v
+	c.f.mu.Unlock()
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct{ f *family }
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{newFamily(name, help, "gauge", nil, labels)}
+}
+
+func (g *Gauge) Set(v float64, values ...string) {
+	g.f.mu.Lock()
+	g.f.get(values).value = v
+	g.f.mu.Unlock()
+}
+
+func (g *Gauge) Add(v float64, values ...string) {
+	g.f.mu.Lock()
+	g.f.get(values).value += v
+	g.f.mu.Unlock()
+}
+
+// Histogram counts the observed values in buckets
+type Histogram struct{ f *family }
+
+// NewHistogram creates the histogram, buckets are the sorted upper bounds
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{newFamily(name, help, "histogram", buckets, labels)}
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+
+	s := h.f.get(values)
+	if i := sort.SearchFloat64s(h.f.buckets, v); i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+// Since observes the seconds elapsed since start
+func (h *Histogram) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeLabels writes {name="value",...}, extra is an additional label pair
+func writeLabels(b *bytes.Buffer, names, values []string, extra ...string) {
+	if len(names) == 0 && len(extra) == 0 {
+		return
+	}
+
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name + `="` + labelReplacer.Replace(values[i]) + `"`)
+	}
+	if len(extra) == 2 {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra[0] + `="` + extra[1] + `"`)
+	}
+	b.WriteByte('}')
+}
+
+func (f *family) write(b *bytes.Buffer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b.WriteString("# HELP " + f.name + " " + helpReplacer.Replace(f.help) + "\n")
+	b.WriteString("# TYPE " + f.name + " " + f.kind + "\n")
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			b.WriteString(f.name)
+			writeLabels(b, f.labels, s.values)
+			b.WriteString(" " + formatFloat(s.value) + "\n")
+			continue
+		}
+
+		var cumulative uint64
+		for i, upper := range f.buckets {
+			cumulative += s.counts[i]
+			b.WriteString(f.name + "_bucket")
+			writeLabels(b, f.labels, s.values, "le", formatFloat(upper))
+			b.WriteString(" " + strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		b.WriteString(f.name + "_bucket")
+		writeLabels(b, f.labels, s.values, "le", "+Inf")
+		b.WriteString(" " + strconv.FormatUint(s.count, 10) + "\n")
+
+		b.WriteString(f.name + "_sum")
+		writeLabels(b, f.labels, s.values)
+		b.WriteString(" " + formatFloat(s.sum) + "\n")
+		b.WriteString(f.name + "_count")
+		writeLabels(b, f.labels, s.values)
+		b.WriteString(" " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+}
+
+// Write writes every metric in the text format, sorted by name
+func Write(w io.Writer) error {
+	mu.Lock()
+	fs := make([]*family, len(families))
+	copy(fs, families)
+	mu.Unlock()
+
+	sort.Sort(byName(fs))
+	b := bytes.NewBuffer(nil)
+	for _, f := range fs {
+		f.write(b)
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+type byName []*family
+
+func (f byName) Len() int           { return len(f) }
+func (f byName) Less(i, j int) bool { return f[i].name < f[j].name }
+func (f byName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// Handler serves the metrics for Prometheus to scrape
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = Write(w)
+	})
+}
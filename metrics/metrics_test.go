@@ -0,0 +1,75 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	c := NewCounter("test_messages_total", "Messages\nreceived.", "command")
+	c.Inc("PRIVMSG")
+	c.Add(2, "PRIVMSG")
+	c.Inc(`we"ird`)
+
+	g := NewGauge("test_connected", "Connected.")
+	g.Set(1)
+
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	b := bytes.NewBuffer(nil)
+	if err := Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP test_connected Connected.
+# TYPE test_connected gauge
+test_connected 1
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 5.55
+test_duration_seconds_count 3
+# HELP test_messages_total Messages\nreceived.
+# TYPE test_messages_total counter
+test_messages_total{command="PRIVMSG"} 3
+test_messages_total{command="we\"ird"} 1
+`
+	if got := b.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(r.(string), "label values") {
+			t.Errorf("expected a panic about the label values, got %v", r)
+		}
+	}()
+
+	NewCounter("test_labels_total", "Labels.", "a", "b").Inc("a")
+}
@@ -0,0 +1,144 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package modules is the registry of the optional parts of the bot, main
+// registers them and every module that the config does not disable gets
+// initialized, receives the irc messages and serves its http routes
+package modules
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sd-bot/commands"
+	"github.com/sztanpet/sd-bot/debug"
+	"github.com/sztanpet/sd-bot/web"
+	"github.com/sztanpet/sirc"
+	"golang.org/x/net/context"
+)
+
+// Route is a path the module serves on the website, or on the admin address
+// if Admin is set
+type Route struct {
+	Path    string
+	Handler http.HandlerFunc
+	Admin   bool
+}
+
+type Module interface {
+	// Name is how the config refers to the module
+	Name() string
+	// Init is called once the irc connection exists, in the order the modules
+	// were registered in
+	Init(ctx context.Context) context.Context
+	// HandleIRC gets every message no handler before it consumed, returns true
+	// to consume the message
+	HandleIRC(c *sirc.IConn, m *irc.Message, tags map[string]string) bool
+	// Commands and Routes are called after Init, the commands are registered
+	// with the default command router, the routes on the web routers
+	Commands() []commands.Command
+	Routes() []Route
+	// Shutdown is called in the reverse order of Init, the module should save
+	// its state and stop its goroutines before ctx is done
+	Shutdown(ctx context.Context) error
+}
+
+var (
+	mu         sync.Mutex
+	registered []Module
+	enabled    []Module
+)
+
+// Register adds the modules to the registry, main calls it before Init
+func Register(ms ...Module) {
+	mu.Lock()
+	registered = append(registered, ms...)
+	mu.Unlock()
+}
+
+// Init initializes the registered modules except the disabled ones, registers
+// their commands and mounts their routes on the web routers
+func Init(ctx context.Context, disabled []string) context.Context {
+	skip := make(map[string]bool, len(disabled))
+	for _, name := range disabled {
+		skip[name] = true
+	}
+
+	mu.Lock()
+	ms := registered
+	mu.Unlock()
+
+	var inited []Module
+	for _, m := range ms {
+		if skip[m.Name()] {
+			d.P("Module disabled:", m.Name())
+			delete(skip, m.Name())
+			continue
+		}
+
+		ctx = m.Init(ctx)
+		commands.Register(m.Commands()...)
+		for _, r := range m.Routes() {
+			if r.Admin {
+				web.Admin.HandleFunc(r.Path, r.Handler)
+			} else {
+				web.Public.HandleFunc(r.Path, r.Handler)
+			}
+		}
+		inited = append(inited, m)
+	}
+
+	for name := range skip {
+		d.Warn("Unknown module in the disabled list", "module", name)
+	}
+
+	mu.Lock()
+	enabled = inited
+	mu.Unlock()
+
+	return ctx
+}
+
+// Enabled returns the initialized modules in the order they were registered
+func Enabled() []Module {
+	mu.Lock()
+	defer mu.Unlock()
+	return enabled
+}
+
+// Shutdown shuts down the enabled modules in the reverse order, returns the
+// first error, the rest are only logged
+func Shutdown(ctx context.Context) error {
+	ms := Enabled()
+	var ret error
+	for i := len(ms) - 1; i >= 0; i-- {
+		err := ms[i].Shutdown(ctx)
+		if err == nil {
+			continue
+		}
+
+		d.Error("Module shutdown failed", "module", ms[i].Name(), "err", err)
+		if ret == nil {
+			ret = err
+		}
+	}
+
+	return ret
+}
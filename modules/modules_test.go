@@ -0,0 +1,83 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package modules
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sd-bot/commands"
+	"github.com/sztanpet/sirc"
+	"golang.org/x/net/context"
+)
+
+type testModule struct {
+	name string
+	log  *[]string
+	err  error
+}
+
+func (t testModule) Name() string { return t.name }
+func (t testModule) Init(ctx context.Context) context.Context {
+	*t.log = append(*t.log, "init "+t.name)
+	return ctx
+}
+func (t testModule) HandleIRC(c *sirc.IConn, m *irc.Message, tags map[string]string) bool {
+	return false
+}
+func (t testModule) Commands() []commands.Command {
+	return []commands.Command{{Prefix: commands.Admin, Name: "test" + t.name}}
+}
+func (t testModule) Routes() []Route { return nil }
+func (t testModule) Shutdown(ctx context.Context) error {
+	*t.log = append(*t.log, "shutdown "+t.name)
+	return t.err
+}
+
+func TestRegistry(t *testing.T) {
+	var log []string
+	errB := errors.New("b failed")
+	Register(
+		testModule{name: "a", log: &log},
+		testModule{name: "b", log: &log, err: errB},
+		testModule{name: "c", log: &log},
+	)
+
+	Init(context.Background(), []string{"c", "nonexistent"})
+	if len(Enabled()) != 2 {
+		t.Fatalf("expected 2 enabled modules, got %d", len(Enabled()))
+	}
+	for name, want := range map[string]bool{"a": true, "b": true, "c": false} {
+		if _, _, ok := commands.Match(".test" + name); ok != want {
+			t.Errorf("expected the command of %s to be registered: %v", name, want)
+		}
+	}
+
+	if err := Shutdown(context.Background()); err != errB {
+		t.Errorf("expected the error of b, got %v", err)
+	}
+
+	want := []string{"init a", "init b", "shutdown b", "shutdown a"}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("got %q, want %q", log, want)
+	}
+}
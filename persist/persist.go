@@ -23,12 +23,29 @@ import (
 	"encoding/gob"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sztanpet/sd-bot/metrics"
+)
+
+var (
+	mu sync.Mutex
+	// every State ever created, so that they can be saved on shutdown
+	states []*State
+
+	saveDuration = metrics.NewHistogram("sdbot_persist_save_duration_seconds",
+		"How long saving the state took.", metrics.DefaultBuckets, "file")
+	saveErrors = metrics.NewCounter("sdbot_persist_save_errors_total",
+		"The number of times the state could not be saved.", "file")
 )
 
 type State struct {
 	sync.Mutex
 	path string
 	data interface{}
+	// 1 if the last save failed, accessed atomically
+	failed int32
 }
 
 func New(p string, d interface{}) (*State, error) {
@@ -57,9 +74,42 @@ func New(p string, d interface{}) (*State, error) {
 		return nil, err
 	}
 
+	mu.Lock()
+	states = append(states, ret)
+	mu.Unlock()
+
 	return ret, nil
 }
 
+// SaveAll saves every State, returns the first error but tries to save every
+// one of them regardless
+func SaveAll() error {
+	mu.Lock()
+	ss := states
+	mu.Unlock()
+
+	var ret error
+	for _, s := range ss {
+		if err := s.Save(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+
+	return ret
+}
+
+// Paths returns the paths of the loaded states
+func Paths() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	ret := make([]string, 0, len(states))
+	for _, s := range states {
+		ret = append(ret, s.path)
+	}
+	return ret
+}
+
 func (s *State) Set(d interface{}) {
 	s.Lock()
 	s.data = d
@@ -74,6 +124,20 @@ func (s *State) Get() interface{} {
 	return ret
 }
 
+// Failed returns the paths of the states whose last save failed
+func Failed() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var ret []string
+	for _, s := range states {
+		if atomic.LoadInt32(&s.failed) == 1 {
+			ret = append(ret, s.path)
+		}
+	}
+	return ret
+}
+
 func (s *State) load(f *os.File) error {
 	d := gob.NewDecoder(f)
 	err := d.Decode(s.data)
@@ -84,13 +148,24 @@ func (s *State) load(f *os.File) error {
 	return nil
 }
 
-func (s *State) Save(lock ...bool) error {
+func (s *State) Save(lock ...bool) (err error) {
 	var needLock bool
 	if len(lock) == 0 || lock[0] {
 		needLock = true
 		s.Lock()
 	}
 
+	start := time.Now()
+	defer func() {
+		saveDuration.Since(start, s.path)
+		if err != nil {
+			saveErrors.Inc(s.path)
+			atomic.StoreInt32(&s.failed, 1)
+		} else {
+			atomic.StoreInt32(&s.failed, 0)
+		}
+	}()
+
 	tmpPath := s.path + ".tmp"
 	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	defer s.close(f, needLock)
@@ -57,3 +57,57 @@ func TestSanity(t *testing.T) {
 		t.Fatalf("unexpected map %#v, err %v", m, err)
 	}
 }
+
+func TestSaveAll(t *testing.T) {
+	_ = os.Remove(testFileName)
+	defer os.Remove(testFileName)
+
+	m := map[string]string{}
+	if _, err := New(testFileName, &m); err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	if ps := Paths(); len(ps) == 0 || ps[len(ps)-1] != testFileName {
+		t.Fatalf("unexpected paths %v", ps)
+	}
+
+	m["foo"] = "bar"
+	if err := SaveAll(); err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	m = map[string]string{}
+	if _, err := New(testFileName, &m); err != nil || m["foo"] != "bar" {
+		t.Fatalf("unexpected map %#v, err %v", m, err)
+	}
+}
+
+func TestFailed(t *testing.T) {
+	_ = os.Remove(testFileName)
+	defer os.Remove(testFileName)
+
+	m := map[string]string{}
+	s, err := New(testFileName, &m)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	// the temporary file can not be created in place of a directory
+	if err := os.Mkdir(testFileName+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err == nil {
+		t.Fatal("expected the save to fail")
+	}
+	if fs := Failed(); len(fs) != 1 || fs[0] != testFileName {
+		t.Fatalf("unexpected failed states %v", fs)
+	}
+
+	_ = os.Remove(testFileName + ".tmp")
+	if err := s.Save(); err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+	if fs := Failed(); len(fs) != 0 {
+		t.Fatalf("unexpected failed states %v", fs)
+	}
+}
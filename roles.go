@@ -0,0 +1,240 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package main
+
+import (
+	"os"
+	"sort"
+
+	"github.com/sztanpet/sd-bot/debug"
+	"github.com/sztanpet/sd-bot/persist"
+)
+
+const (
+	roleOwner         = "owner"
+	roleAdmin         = "admin"
+	roleFactoidEditor = "factoid-editor"
+	roleAnnouncer     = "announcer"
+)
+
+const (
+	permRaw      = "raw"      // .raw
+	permRoles    = "roles"    // .grant, .revoke, .addadmin, .deladmin
+	permFactoids = "factoids" // every factoid administration command, see factoids/commands.go
+	permAnnounce = "announce" // .announce
+	permAudit    = "audit"    // .audit
+)
+
+// the permissions every role grants, managing the roles is left to the
+// owners, so that admins cannot make admins of each other or demote one
+var rolePermissions = map[string][]string{
+	roleOwner:         {permRaw, permRoles, permFactoids, permAnnounce, permAudit},
+	roleAdmin:         {permRaw, permFactoids, permAnnounce, permAudit},
+	roleFactoidEditor: {permFactoids},
+	roleAnnouncer:     {permAnnounce},
+}
+
+var (
+	roleState *persist.State
+	// account name -> sorted roles
+	roles map[string][]string
+	// the owners from the config
+	owners []string
+)
+
+func initRoles(cfgOwners []string) {
+	owners = cfgOwners
+
+	// roles.state replaced admins.state, migrate the admins over if this is
+	// the first start since
+	_, err := os.Stat("roles.state")
+	migrate := os.IsNotExist(err)
+
+	roleState, err = persist.New("roles.state", &map[string][]string{})
+	if err != nil {
+		d.F(err.Error())
+	}
+
+	roles = *roleState.Get().(*map[string][]string)
+	if migrate {
+		migrateAdmins()
+	}
+
+	if len(owners) == 0 {
+		d.Warn("No owners configured, nobody will be able to grant the owner role")
+	}
+}
+
+// isOwner returns whether the user is one of the owners in the config, they
+// always have the owner role regardless of roles.state
+func isOwner(user string) bool {
+	for _, owner := range owners {
+		if user == owner {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isPrivileged returns whether the user has any role at all
+func isPrivileged(user string) bool {
+	roleState.Lock()
+	defer roleState.Unlock()
+
+	return len(roles[user]) > 0 || isOwner(user)
+}
+
+// the account the old bot wrote into every admins.state, it is not migrated
+// unless it is an owner in the config, it was never chosen by the deployment
+const seededAdmin = "sztanpet"
+
+// migrateAdmins grants the admin role to everyone in the old admins.state
+func migrateAdmins() {
+	if _, err := os.Stat("admins.state"); err != nil {
+		return
+	}
+
+	adminState, err := persist.New("admins.state", &map[string]struct{}{})
+	if err != nil {
+		d.Error("Could not migrate admins.state", "err", err)
+		return
+	}
+	admins := *adminState.Get().(*map[string]struct{})
+
+	roleState.Lock()
+	for user := range admins {
+		if user == seededAdmin && !isOwner(user) {
+			d.Warn("Not migrating the admin the old bot added by default, add it to the owners in the config if it is wanted", "account", user)
+			continue
+		}
+		grantRole(user, roleAdmin)
+	}
+	roleState.Save(false)
+	roleState.Unlock()
+
+	d.P("Migrated admins.state to roles.state", admins)
+}
+
+// roleNames returns the names of the roles, sorted
+func roleNames() []string {
+	ret := make([]string, 0, len(rolePermissions))
+	for role := range rolePermissions {
+		ret = append(ret, role)
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+func isRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// hasRole returns whether the user has the role
+// the role state lock needs to be held by the caller
+func hasRole(user, role string) bool {
+	if role == roleOwner && isOwner(user) {
+		return true
+	}
+
+	return hasGrantedRole(user, role)
+}
+
+// hasGrantedRole returns whether the user was granted the role, ignoring the
+// owners in the config
+// the role state lock needs to be held by the caller
+func hasGrantedRole(user, role string) bool {
+	r := roles[user]
+	pos := sort.SearchStrings(r, role)
+	return pos < len(r) && r[pos] == role
+}
+
+// hasPermission returns whether any of the roles of the user grants the perm
+func hasPermission(user, perm string) bool {
+	roleState.Lock()
+	defer roleState.Unlock()
+
+	if isOwner(user) {
+		return true
+	}
+
+	for _, role := range roles[user] {
+		for _, p := range rolePermissions[role] {
+			if p == perm {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// grantRole returns false if the user already had the role
+// the role state lock needs to be held by the caller
+func grantRole(user, role string) bool {
+	r := roles[user]
+	pos := sort.SearchStrings(r, role)
+	if pos < len(r) && r[pos] == role {
+		return false
+	}
+
+	r = append(r, "")
+	copy(r[pos+1:], r[pos:])
+	r[pos] = role
+	roles[user] = r
+	return true
+}
+
+// revokeRole returns false if the user did not have the role
+// the role state lock needs to be held by the caller
+func revokeRole(user, role string) bool {
+	r := roles[user]
+	pos := sort.SearchStrings(r, role)
+	if pos == len(r) || r[pos] != role {
+		return false
+	}
+
+	r = append(r[:pos], r[pos+1:]...)
+	if len(r) == 0 {
+		delete(roles, user)
+	} else {
+		roles[user] = r
+	}
+	return true
+}
+
+// usersWithRole returns the sorted list of users with the role
+// the role state lock needs to be held by the caller
+func usersWithRole(role string) []string {
+	var ret []string
+	for user := range roles {
+		if hasGrantedRole(user, role) && (role != roleOwner || !isOwner(user)) {
+			ret = append(ret, user)
+		}
+	}
+	if role == roleOwner {
+		ret = append(ret, owners...)
+	}
+
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,185 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/sztanpet/sd-bot/commands"
+	"github.com/sztanpet/sd-bot/persist"
+)
+
+// testRoles loads the roles in a temporary directory with the given owners in
+// the config, the old admins.state is created first if admins is not nil,
+// returns a function that cleans up
+func testRoles(t *testing.T, cfgOwners []string, admins map[string]struct{}) func() {
+	dir, err := ioutil.TempDir("", "sd-bot-roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		_ = os.Chdir(wd)
+		_ = os.RemoveAll(dir)
+	}
+
+	if admins != nil {
+		if _, err := persist.New("admins.state", &admins); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	initRoles(cfgOwners)
+	return cleanup
+}
+
+func TestHasPermission(t *testing.T) {
+	defer testRoles(t, []string{"lennart"}, nil)()
+	roleState.Lock()
+	grantRole("kay", roleOwner)
+	grantRole("armin", roleAdmin)
+	grantRole("zbyszek", roleFactoidEditor)
+	grantRole("david", roleAnnouncer)
+	roleState.Unlock()
+
+	perms := []string{permRaw, permRoles, permFactoids, permAnnounce, permAudit}
+	tests := []struct {
+		user  string
+		perms []string
+	}{
+		{"lennart", perms}, // from the config
+		{"kay", perms},
+		{"armin", []string{permRaw, permFactoids, permAnnounce, permAudit}},
+		{"zbyszek", []string{permFactoids}},
+		{"david", []string{permAnnounce}},
+		{"nobody", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, perm := range perms {
+			if hasPermission(tt.user, perm) {
+				got = append(got, perm)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.perms) {
+			t.Errorf("%s: expected %v, got %v", tt.user, tt.perms, got)
+		}
+		if privileged := isPrivileged(tt.user); privileged != (tt.perms != nil) {
+			t.Errorf("%s: unexpected privileged %v", tt.user, privileged)
+		}
+	}
+}
+
+func TestChangeRole(t *testing.T) {
+	defer testRoles(t, []string{"lennart"}, nil)()
+
+	tests := []struct {
+		user    string
+		grant   bool
+		target  string
+		role    string
+		outcome string
+	}{
+		{"lennart", true, "armin", "nonexistent", commands.Usage},
+		{"lennart", true, "", roleAdmin, commands.Usage},
+		{"lennart", true, "armin", roleAdmin, commands.OK},
+		{"lennart", true, "armin", roleAdmin, commands.Unchanged},
+		// only owners can hand out the owner role
+		{"armin", true, "armin", roleOwner, commands.Denied},
+		{"armin", false, "lennart", roleOwner, commands.Denied},
+		{"lennart", true, "kay", roleOwner, commands.OK},
+		{"kay", true, "zbyszek", roleFactoidEditor, commands.OK},
+		// the owners of the config stay owners
+		{"kay", false, "lennart", roleOwner, commands.Refused},
+		{"kay", false, "kay", roleOwner, commands.OK},
+		{"lennart", false, "kay", roleOwner, commands.Unchanged},
+		{"lennart", false, "armin", roleAdmin, commands.OK},
+		{"lennart", false, "armin", roleAdmin, commands.Unchanged},
+	}
+	for i, tt := range tests {
+		if msg, outcome := changeRole(tt.user, tt.grant, tt.target, tt.role); outcome != tt.outcome {
+			t.Errorf("%d: expected %s, got %s: %s", i, tt.outcome, outcome, msg)
+		}
+	}
+
+	roleState.Lock()
+	defer roleState.Unlock()
+	if want := map[string][]string{"zbyszek": {roleFactoidEditor}}; !reflect.DeepEqual(roles, want) {
+		t.Errorf("unexpected roles %v", roles)
+	}
+}
+
+func TestLastOwner(t *testing.T) {
+	// without owners in the config, the granted owners are all there is
+	defer testRoles(t, nil, nil)()
+	roleState.Lock()
+	grantRole("kay", roleOwner)
+	grantRole("lennart", roleOwner)
+	roleState.Unlock()
+
+	if msg, outcome := changeRole("kay", false, "lennart", roleOwner); outcome != commands.OK {
+		t.Fatalf("expected to revoke, got %s: %s", outcome, msg)
+	}
+	if msg, outcome := changeRole("kay", false, "kay", roleOwner); outcome != commands.Refused {
+		t.Fatalf("expected the last owner to stay, got %s: %s", outcome, msg)
+	}
+	if !hasPermission("kay", permRoles) {
+		t.Fatal("the last owner lost the role")
+	}
+}
+
+func TestMigrateAdmins(t *testing.T) {
+	old := map[string]struct{}{"armin": {}, "kay": {}, seededAdmin: {}}
+	defer testRoles(t, []string{"lennart"}, old)()
+
+	roleState.Lock()
+	want := map[string][]string{"armin": {roleAdmin}, "kay": {roleAdmin}}
+	if !reflect.DeepEqual(roles, want) {
+		t.Errorf("unexpected roles %v", roles)
+	}
+	roleState.Unlock()
+
+	// only the first start after the upgrade migrates
+	_, outcome := changeRole("lennart", false, "kay", roleAdmin)
+	initRoles([]string{"lennart"})
+	if outcome != commands.OK || hasPermission("kay", permRaw) {
+		t.Errorf("kay got the admin role back, %s", outcome)
+	}
+}
+
+func TestMigrateSeededAdmin(t *testing.T) {
+	// the default admin of the old bot is kept if the config says so
+	defer testRoles(t, []string{seededAdmin}, map[string]struct{}{seededAdmin: {}})()
+
+	roleState.Lock()
+	defer roleState.Unlock()
+	if !hasGrantedRole(seededAdmin, roleAdmin) {
+		t.Errorf("unexpected roles %v", roles)
+	}
+}
@@ -0,0 +1,186 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+	"github.com/sztanpet/sd-bot/debug"
+	"github.com/sztanpet/sirc"
+)
+
+const (
+	saslIdle = iota
+	saslStarted
+	saslDone
+)
+
+// the maximum length of a single AUTHENTICATE payload
+const saslChunkSize = 400
+
+type saslState struct {
+	mu       sync.Mutex
+	mech     string // PLAIN or EXTERNAL, empty if SASL is not used
+	account  string
+	password string
+	state    int
+	success  bool
+}
+
+var sasl = &saslState{}
+
+func (s *saslState) configure(mech, account, password string) {
+	mech = strings.ToUpper(mech)
+	switch {
+	case mech == "PLAIN" && password == "":
+		mech = ""
+	case mech != "" && mech != "PLAIN" && mech != "EXTERNAL":
+		d.Warn("Unknown SASL mechanism, not using SASL", "mechanism", mech)
+		mech = ""
+	}
+
+	s.mu.Lock()
+	s.mech = mech
+	s.account = account
+	s.password = password
+	s.mu.Unlock()
+}
+
+func (s *saslState) reset() {
+	s.mu.Lock()
+	s.state = saslIdle
+	s.success = false
+	s.mu.Unlock()
+}
+
+func (s *saslState) configured() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mech != ""
+}
+
+// supported returns whether the configured mechanism is in the comma separated
+// list of mechanisms, an empty list means the server did not tell
+func (s *saslState) supported(mechs string) bool {
+	if mechs == "" {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, mech := range strings.Split(mechs, ",") {
+		if strings.ToUpper(mech) == s.mech {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *saslState) started() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state != saslIdle
+}
+
+// result returns whether authentication was attempted and whether it succeeded
+func (s *saslState) result() (attempted, success bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state != saslIdle, s.success
+}
+
+func (s *saslState) finish(c *sirc.IConn, success bool) {
+	s.mu.Lock()
+	s.state = saslDone
+	s.success = success
+	s.mu.Unlock()
+	endCaps(c)
+}
+
+func startSASL(c *sirc.IConn) {
+	sasl.mu.Lock()
+	sasl.state = saslStarted
+	mech := sasl.mech
+	sasl.mu.Unlock()
+
+	c.Write(&irc.Message{
+		Command: "AUTHENTICATE",
+		Params:  []string{mech},
+	})
+}
+
+// handleSASL handles the SASL exchange during registration
+func handleSASL(c *sirc.IConn, m *irc.Message) bool {
+	switch m.Command {
+	case "AUTHENTICATE":
+		// >> AUTHENTICATE +
+		// << AUTHENTICATE base64(authzid \0 authcid \0 password)
+		sasl.mu.Lock()
+		mech, account, password := sasl.mech, sasl.account, sasl.password
+		sasl.mu.Unlock()
+
+		var payload string
+		if mech == "PLAIN" {
+			payload = base64.StdEncoding.EncodeToString([]byte(account + "\x00" + account + "\x00" + password))
+		}
+		writeAuthenticate(c, payload)
+	case "900": // RPL_LOGGEDIN
+		// >> :server 900 sd-bot sd-bot!bot@host account :You are now logged in as account
+		if len(m.Params) > 2 {
+			d.P("Logged in to services as", m.Params[2])
+		}
+		return false
+	case "903", "907": // RPL_SASLSUCCESS, ERR_SASLALREADY
+		d.P("SASL authentication successful")
+		sasl.finish(c, true)
+	case "902", "904", "905", "906": // ERR_NICKLOCKED, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED
+		d.Error("SASL authentication failed, check the account and password/certificate in the config", "reply", m.Command, "reason", m.Trailing)
+		sasl.finish(c, false)
+	case "908": // RPL_SASLMECHS
+		d.P("The server supports these SASL mechanisms", m.Params)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// writeAuthenticate sends the payload in chunks, an empty payload or one that
+// ends exactly at a chunk boundary has to be followed by a lone +
+func writeAuthenticate(c *sirc.IConn, payload string) {
+	for len(payload) >= saslChunkSize {
+		c.Write(&irc.Message{
+			Command: "AUTHENTICATE",
+			Params:  []string{payload[:saslChunkSize]},
+		})
+		payload = payload[saslChunkSize:]
+	}
+
+	if payload == "" {
+		payload = "+"
+	}
+	c.Write(&irc.Message{
+		Command: "AUTHENTICATE",
+		Params:  []string{payload},
+	})
+}
@@ -0,0 +1,135 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package services abstracts away the differences between the services
+// packages of the irc networks, like how to identify with NickServ and how to
+// find out the account of a user
+package services
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// Services is implemented for every supported services package
+type Services interface {
+	// Identify returns the message identifying the bot with NickServ
+	Identify(account, password string) *irc.Message
+	// Info returns the message asking NickServ about the account of the nick,
+	// used when WHOIS is not available, nil if not supported
+	Info(nick string) *irc.Message
+	// ParseInfo parses the reply of NickServ to Info, returns the nick and
+	// its account, ok is false if the message was not such a reply
+	ParseInfo(m *irc.Message) (nick, account string, ok bool)
+	// TrustRegNick returns whether RPL_WHOISREGNICK (307) means that the user
+	// is identified to the account named the same as the nick
+	TrustRegNick() bool
+}
+
+// New returns the implementation with the given name, atheme if empty
+func New(name string) (Services, error) {
+	switch strings.ToLower(name) {
+	case "", "atheme", "libera", "freenode":
+		return atheme{}, nil
+	case "anope":
+		return anope{}, nil
+	case "oftc":
+		return oftc{}, nil
+	}
+
+	return nil, errors.New("unknown services: " + name)
+}
+
+func nickserv(text string) *irc.Message {
+	return &irc.Message{
+		Command:  irc.PRIVMSG,
+		Params:   []string{"NickServ"},
+		Trailing: text,
+	}
+}
+
+func fromNickserv(m *irc.Message) bool {
+	return m.Command == irc.NOTICE && m.Prefix != nil && m.Prefix.Name == "NickServ"
+}
+
+// atheme is used on Libera and freenode
+type atheme struct{}
+
+// freenode: Information on armin (account \x02armin\x02):
+// Libera:   Information on \x02armin\x02 (account \x02armin\x02):
+var athemeInfoRE = regexp.MustCompile(`^Information on \x02?([^ \x02]+)\x02? \(account \x02?([^ \x02)]+)\x02?\)`)
+
+func (atheme) Identify(account, password string) *irc.Message {
+	return nickserv("IDENTIFY " + account + " " + password)
+}
+
+func (atheme) Info(nick string) *irc.Message {
+	return nickserv("INFO " + nick)
+}
+
+func (atheme) ParseInfo(m *irc.Message) (string, string, bool) {
+	if !fromNickserv(m) {
+		return "", "", false
+	}
+
+	matches := athemeInfoRE.FindStringSubmatch(m.Trailing)
+	if len(matches) == 0 {
+		return "", "", false
+	}
+	return matches[1], matches[2], true
+}
+
+func (atheme) TrustRegNick() bool { return false }
+
+// anope, usually paired with UnrealIRCd or InspIRCd, the former only sends
+// 307 in WHOIS for identified users
+type anope struct{}
+
+func (anope) Identify(account, password string) *irc.Message {
+	return nickserv("IDENTIFY " + account + " " + password)
+}
+
+// Anope does not rate-limit WHOIS the way freenode did, and its INFO output
+// does not say which nick a line belongs to, so the fallback is not used
+func (anope) Info(nick string) *irc.Message { return nil }
+
+func (anope) ParseInfo(m *irc.Message) (string, string, bool) {
+	return "", "", false
+}
+
+func (anope) TrustRegNick() bool { return true }
+
+// oftc runs its own services, the ircd sends 307 for identified users
+type oftc struct{}
+
+// unlike the others, the password comes first
+func (oftc) Identify(account, password string) *irc.Message {
+	return nickserv("IDENTIFY " + password + " " + account)
+}
+
+func (oftc) Info(nick string) *irc.Message { return nil }
+
+func (oftc) ParseInfo(m *irc.Message) (string, string, bool) {
+	return "", "", false
+}
+
+func (oftc) TrustRegNick() bool { return true }
@@ -0,0 +1,65 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package services
+
+import (
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestAthemeInfo(t *testing.T) {
+	svc, err := New("")
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	for _, text := range []string{
+		"Information on armin (account \x02armin2\x02):",         // freenode
+		"Information on \x02armin\x02 (account \x02armin2\x02):", // Libera
+	} {
+		nick, account, ok := svc.ParseInfo(&irc.Message{
+			Prefix:   &irc.Prefix{Name: "NickServ"},
+			Command:  irc.NOTICE,
+			Trailing: text,
+		})
+		if !ok || nick != "armin" || account != "armin2" {
+			t.Fatalf("unexpected result for %q: %v %v %v", text, nick, account, ok)
+		}
+	}
+
+	if _, _, ok := svc.ParseInfo(&irc.Message{
+		Prefix:   &irc.Prefix{Name: "armin"},
+		Command:  irc.NOTICE,
+		Trailing: "Information on armin (account \x02armin\x02):",
+	}); ok {
+		t.Fatalf("accepted a notice not from NickServ")
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	oftc, _ := New("oftc")
+	if m := oftc.Identify("bot", "secret"); m.Trailing != "IDENTIFY secret bot" {
+		t.Fatalf("unexpected identify %q", m.Trailing)
+	}
+	if _, err := New("unknown"); err == nil {
+		t.Fatalf("expected an error for unknown services")
+	}
+}
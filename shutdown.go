@@ -0,0 +1,88 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sztanpet/sd-bot/config"
+	"github.com/sztanpet/sd-bot/debug"
+	"github.com/sztanpet/sd-bot/modules"
+	"github.com/sztanpet/sd-bot/persist"
+	"github.com/sztanpet/sd-bot/systemd"
+	"github.com/sztanpet/sirc"
+	"golang.org/x/net/context"
+)
+
+// used if the config does not set the shutdown timeout
+const defaultShutdownTimeout = 10 * time.Second
+
+// handleSignals shuts the bot down on SIGTERM or SIGINT, the returned channel
+// is closed once the shutdown finished, a second signal kills the bot
+func handleSignals(ctx context.Context, servers ...*http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		d.P("Shutting down, received", sig)
+		if err := systemd.Stopping(); err != nil {
+			d.Warn("Could not notify systemd", "err", err)
+		}
+
+		shutdown(ctx, servers)
+		close(done)
+	}()
+
+	return done
+}
+
+// shutdown stops accepting requests and waits for the ones in progress, shuts
+// down the modules, saves every state and quits irc
+func shutdown(ctx context.Context, servers []*http.Server) {
+	cfg := config.FromContext(ctx)
+	timeout := time.Duration(cfg.Website.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// the webhooks write to irc, so no new ones can arrive after the QUIT
+	for _, srv := range servers {
+		if err := srv.Shutdown(sctx); err != nil {
+			d.Error("Could not shut down the http server cleanly", "addr", srv.Addr, "err", err)
+		}
+	}
+	if err := modules.Shutdown(sctx); err != nil {
+		d.Error("Could not shut down the modules cleanly", "err", err)
+	}
+	if err := persist.SaveAll(); err != nil {
+		d.Error("Could not save the state", "err", err)
+	}
+
+	quitIRC(sctx, sirc.FromContext(ctx), cfg.IRC.QuitMessage)
+}
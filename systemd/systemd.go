@@ -0,0 +1,152 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package systemd implements the parts of the systemd service protocols the
+// bot uses without linking against libsystemd: sd_notify(3), the watchdog and
+// socket activation, see sd_listen_fds(3)
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the first file descriptor passed with socket activation
+const listenFdsStart = 3
+
+var (
+	notifyOnce sync.Once
+	notifyAddr *net.UnixAddr
+)
+
+// Notify sends the state to the service manager, like "READY=1", it is a no-op
+// if the bot was not started by systemd with Type=notify, or
+// NotifyAccess= set
+func Notify(state string) error {
+	notifyOnce.Do(func() {
+		name := os.Getenv("NOTIFY_SOCKET")
+		if name == "" {
+			return
+		}
+		// abstract socket
+		if name[0] == '@' {
+			name = "\x00" + name[1:]
+		}
+		notifyAddr = &net.UnixAddr{Name: name, Net: "unixgram"}
+	})
+
+	if notifyAddr == nil {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, notifyAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Ready tells the service manager that the bot finished starting up
+func Ready() error {
+	return Notify("READY=1")
+}
+
+// Status sets the status line shown by systemctl status
+func Status(status string) error {
+	return Notify("STATUS=" + status)
+}
+
+// Stopping tells the service manager that the bot is shutting down
+func Stopping() error {
+	return Notify("STOPPING=1")
+}
+
+// WatchdogInterval returns how often the watchdog has to be pinged, zero if
+// the watchdog is not enabled for the bot
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog pings the watchdog at half of the interval for as long as alive
+// returns true, systemd restarts the bot once it stops, returns immediately
+// if the watchdog is not enabled
+func Watchdog(alive func() bool) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval / 2) {
+			if alive() {
+				_ = Notify("WATCHDOG=1")
+			}
+		}
+	}()
+}
+
+// Listeners returns the sockets passed by the service manager with socket
+// activation, in the order of the ListenStream= lines of the .socket unit
+// the environment variables are unset so that child processes do not inherit
+// them, so only the first call returns the listeners
+func Listeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	ret := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, l)
+	}
+
+	return ret, nil
+}
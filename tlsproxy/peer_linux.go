@@ -0,0 +1,85 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package tlsproxy
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ownConn returns whether the connection was made by the user the bot runs
+// as, the owner of the connecting socket is in /proc/net/tcp
+func ownConn(conn net.Conn) bool {
+	local, ok1 := conn.LocalAddr().(*net.TCPAddr)
+	remote, ok2 := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return false
+	}
+
+	f, err := os.Open("/proc/net/tcp")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		// the socket of the client, its local address is our remote one
+		if !procAddrEqual(fields[1], remote) || !procAddrEqual(fields[2], local) {
+			continue
+		}
+
+		uid, err := strconv.Atoi(fields[7])
+		return err == nil && uid == os.Getuid()
+	}
+
+	return false
+}
+
+// procAddrEqual compares the "0100007F:1F90" form of /proc/net/tcp, the ip is
+// a 32 bit number in host byte order, so both orders are accepted
+func procAddrEqual(s string, addr *net.TCPAddr) bool {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return false
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil || int(port) != addr.Port {
+		return false
+	}
+
+	ip, err := hex.DecodeString(parts[0])
+	ip4 := addr.IP.To4()
+	if err != nil || len(ip) != net.IPv4len || ip4 == nil {
+		return false
+	}
+
+	reversed := net.IP{ip[3], ip[2], ip[1], ip[0]}
+	return ip4.Equal(net.IP(ip)) || ip4.Equal(reversed)
+}
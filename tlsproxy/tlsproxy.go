@@ -0,0 +1,236 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package tlsproxy connects to the irc server over TLS on behalf of sirc,
+// which only knows how to dial plaintext connections
+// it listens on a random loopback port, and for every connection it accepts
+// it dials the irc server with TLS and copies the data back and forth
+// Relay does the same without TLS, so that the lines sirc sends can be seen
+// with Sent on plaintext connections too, and Preamble can be sent before them
+package tlsproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sztanpet/sd-bot/config"
+	"github.com/sztanpet/sd-bot/debug"
+)
+
+const dialTimeout = 30 * time.Second
+
+// Sent is called with every line sent to the irc server, Received with every
+// line received from it before sirc gets it, without the line ending, if set
+// before Listen or Relay
+var (
+	Sent     func(line []byte)
+	Received func(line []byte)
+)
+
+// Preamble is sent to the irc server right after connecting, before anything
+// sirc sends, if set before Listen or Relay
+var Preamble []byte
+
+// TLSConfig builds the tls configuration from the irc config, using the CA
+// bundle and client certificate if they are given
+func TLSConfig(cfg config.IRC) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.ServerName != "" {
+		tc.ServerName = cfg.ServerName
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + cfg.CAFile)
+		}
+	}
+
+	// the client certificate is used for CertFP and SASL EXTERNAL
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+// Listen starts listening on a random loopback port and returns its address,
+// which is what sirc has to connect to instead of the irc server
+func Listen(cfg config.IRC) (string, error) {
+	tc, err := TLSConfig(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	return listen(func() (net.Conn, error) {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", cfg.Addr, tc)
+		if err != nil {
+			d.Error("Could not connect to the irc server with TLS", "addr", cfg.Addr, "err", err)
+		}
+		return conn, err
+	})
+}
+
+// Relay is Listen for plaintext connections
+func Relay(addr string) (string, error) {
+	return listen(func() (net.Conn, error) {
+		conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+		if err != nil {
+			d.Error("Could not connect to the irc server", "addr", addr, "err", err)
+		}
+		return conn, err
+	})
+}
+
+// listen accepts one connection at a time, the connections get the identity
+// of the bot (the client certificate), so connections of other users and a
+// second connection while one is proxied are refused, the listener stays open
+// for the whole lifetime of the bot so that nobody else can take the address
+// sirc reconnects to
+func listen(dial func() (net.Conn, error)) (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	// the hooks are read once, the proxied connections outlive the caller
+	h := hooks{sent: Sent, received: Received, preamble: Preamble}
+	// 1 while a connection is proxied, accessed atomically
+	var inUse int32
+	go (func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				d.Error("tlsproxy accept failed", "err", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			if !ownConn(conn) {
+				d.Warn("tlsproxy refused a connection of another user", "remote", conn.RemoteAddr())
+				_ = conn.Close()
+				continue
+			}
+			if !atomic.CompareAndSwapInt32(&inUse, 0, 1) {
+				d.Warn("tlsproxy refused a second connection", "remote", conn.RemoteAddr())
+				_ = conn.Close()
+				continue
+			}
+
+			go (func() {
+				proxy(conn, dial, h)
+				atomic.StoreInt32(&inUse, 0)
+			})()
+		}
+	})()
+
+	return ln.Addr().String(), nil
+}
+
+// hooks are Sent, Received and Preamble as they were when listening started
+type hooks struct {
+	sent     func(line []byte)
+	received func(line []byte)
+	preamble []byte
+}
+
+func proxy(conn net.Conn, dial func() (net.Conn, error), h hooks) {
+	defer conn.Close()
+
+	upstream, err := dial()
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyConn := func(dst io.Writer, src io.Reader) {
+		_, _ = io.Copy(dst, src)
+		// unblock the other direction too
+		_ = upstream.Close()
+		_ = conn.Close()
+		wg.Done()
+	}
+
+	var up, down io.Writer = upstream, conn
+	if h.sent != nil {
+		up = &lineTap{w: upstream, fn: h.sent}
+	}
+	if h.received != nil {
+		down = &lineTap{w: conn, fn: h.received}
+	}
+	if len(h.preamble) > 0 {
+		if _, err := up.Write(h.preamble); err != nil {
+			return
+		}
+	}
+	go copyConn(up, conn)
+	go copyConn(down, upstream)
+	wg.Wait()
+}
+
+// lineTap calls fn with every complete line written through it
+type lineTap struct {
+	w   io.Writer
+	fn  func([]byte)
+	buf []byte
+}
+
+func (t *lineTap) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	for {
+		pos := bytes.IndexByte(t.buf, '\n')
+		if pos < 0 {
+			break
+		}
+		t.fn(bytes.TrimRight(t.buf[:pos], "\r"))
+		t.buf = t.buf[pos+1:]
+	}
+	// do not hold on to the backing array of a long burst of lines
+	if len(t.buf) == 0 {
+		t.buf = nil
+	}
+
+	return t.w.Write(p)
+}
@@ -0,0 +1,353 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package tlsproxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sztanpet/sd-bot/config"
+)
+
+// writeCert creates a certificate signed by parent (self-signed if nil) and
+// writes it and its key into dir, returns the paths and the certificate
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certPath, keyPath, cert, key
+}
+
+func TestProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caPath, _, ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	serverCert, serverKey, _, _ := writeCert(t, dir, "irc.example.org", ca, caKey)
+	clientCert, clientKey, _, _ := writeCert(t, dir, "sd-bot", ca, caKey)
+
+	// the stand-in for the irc server, requires a client certificate
+	pair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go (func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if line != "NICK sd-bot\r\n" {
+			return
+		}
+		tc := conn.(*tls.Conn)
+		name := tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Write([]byte(":irc.example.org 001 " + name + " :Welcome\r\n"))
+	})()
+
+	addr, err := Listen(config.IRC{
+		Addr:       ln.Addr().String(),
+		CAFile:     caPath,
+		ServerName: "irc.example.org",
+		CertFile:   clientCert,
+		KeyFile:    clientKey,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("NICK sd-bot\r\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != ":irc.example.org 001 sd-bot :Welcome\r\n" {
+		t.Fatalf("unexpected line %q, err %v", line, err)
+	}
+}
+
+func TestServerNameMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caPath, _, ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	serverCert, serverKey, _, _ := writeCert(t, dir, "irc.example.org", ca, caKey)
+	pair, _ := tls.LoadX509KeyPair(serverCert, serverKey)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go (func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Write([]byte("should never be read\r\n"))
+			conn.Close()
+		}
+	})()
+
+	addr, err := Listen(config.IRC{
+		Addr:       ln.Addr().String(),
+		CAFile:     caPath,
+		ServerName: "irc.example.net",
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the proxy has to refuse the certificate and close the connection
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestRelaySent(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go (func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		r.ReadString('\n')
+		r.ReadString('\n')
+		conn.Write([]byte(":irc.example.org 001 sd-bot :Welcome\r\n"))
+	})()
+
+	sent := make(chan string, 2)
+	Sent = func(line []byte) { sent <- string(line) }
+	defer (func() { Sent = nil })()
+
+	addr, err := Relay(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// a line split across writes is still seen once
+	conn.Write([]byte("NICK sd-bot\r\nUSER sd"))
+	conn.Write([]byte("-bot 0 * :sd-bot\r\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != ":irc.example.org 001 sd-bot :Welcome\r\n" {
+		t.Fatalf("unexpected line %q, err %v", line, err)
+	}
+
+	for _, want := range []string{"NICK sd-bot", "USER sd-bot 0 * :sd-bot"} {
+		if got := <-sent; got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestPreamble(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	lines := make(chan string, 2)
+	go (func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			line, _ := r.ReadString('\n')
+			lines <- line
+		}
+	})()
+
+	Preamble = []byte("CAP LS 302\r\n")
+	defer (func() { Preamble = nil })()
+
+	addr, err := Relay(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("NICK sd-bot\r\n"))
+
+	for _, want := range []string{"CAP LS 302\r\n", "NICK sd-bot\r\n"} {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Fatalf("expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestOneConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go (func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(":irc.example.org NOTICE * :hello\r\n"))
+			go (func() {
+				// keep it open until the client closes it
+				bufio.NewReader(conn).ReadString('\n')
+				conn.Close()
+			})()
+		}
+	})()
+
+	addr, err := Relay(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	connect := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			conn.Close()
+			return nil
+		}
+		return conn
+	}
+
+	first := connect()
+	if first == nil {
+		t.Fatal("expected the first connection to work")
+	}
+	if second := connect(); second != nil {
+		second.Close()
+		t.Fatal("expected the second connection to be refused while the first is open")
+	}
+
+	// sirc reconnects to the same address
+	first.Close()
+	var again net.Conn
+	for i := 0; i < 50 && again == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		again = connect()
+	}
+	if again == nil {
+		t.Fatal("expected a connection after the first one closed")
+	}
+	again.Close()
+}
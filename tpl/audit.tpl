@@ -0,0 +1,52 @@
+<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta http-equiv="X-UA-Compatible" content="IE=edge">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>systemd-bot audit log</title>
+    <link rel="stylesheet" href="//netdna.bootstrapcdn.com/bootstrap/3.1.1/css/bootstrap.min.css">
+    <style>
+      .nobr {
+        white-space: nowrap;
+      }
+    </style>
+  </head>
+  <body>
+    <div class="container-fluid">
+      <div class="row">
+        <div class="panel panel-default">
+          <div class="panel-heading">
+            <h2 class="panel-title">Audit log</h2>
+          </div>
+          <table class="table table-striped">
+            <tr>
+              <th>Time</th>
+              <th>Nick</th>
+              <th>Account</th>
+              <th>Channel/address</th>
+              <th>Command</th>
+              <th>Arguments</th>
+              <th>Result</th>
+            </tr>
+            {{range .}}
+              <tr>
+                <td class="nobr">{{.Time.Format "2006-01-02 15:04:05"}}</td>
+                <td>{{.Nick}}</td>
+                <td>{{.Account}}</td>
+                <td>{{.Channel}}{{.Remote}}</td>
+                <td class="nobr">.{{.Command}}</td>
+                <td>{{.Args}}</td>
+                <td>{{.Result}}</td>
+              </tr>
+            {{else}}
+              <tr>
+                <td colspan="7">Nothing has been logged yet.</td>
+              </tr>
+            {{end}}
+          </table>
+        </div>
+      </div>
+    </div>
+  </body>
+</html>
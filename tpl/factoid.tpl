@@ -63,6 +63,16 @@
       .factoids td.factoid-aliases li {
         list-style-type: none;
       }
+      .factoids .factoid-tags .label {
+        display: inline-block;
+        margin: 0 2px 2px 0;
+      }
+      .tag-filter {
+        padding: 10px 15px;
+      }
+      .tag-filter .btn {
+        margin: 0 2px 2px 0;
+      }
 
 
       footer {
@@ -104,6 +114,7 @@
         <div class="collapse navbar-collapse" id="menu">
           <ul class="nav navbar-nav">
             <li class="active"><a href="#factoids">Factoids</a></li>
+            <li><a href="#proposals">Proposals{{with .Proposals}} <span class="badge">{{len .}}</span>{{end}}</a></li>
             <li><a href="#command-help">Command help</a></li>
           </ul>
         </div>
@@ -116,15 +127,27 @@
           <div class="panel-heading">
             <h2 id="factoids" class="panel-title">Factoids</h2>
           </div>
+          {{if .Tags}}
+            <div class="tag-filter">
+              <a class="btn btn-xs btn-primary" href="#factoids" data-tag="">all</a>
+              {{range .Tags}}
+                <a class="btn btn-xs btn-default" href="#tag-{{.}}" data-tag="{{.}}">{{.}}</a>
+              {{end}}
+            </div>
+          {{end}}
           <table class="table table-striped">
             <tr>
               <th class="factoid-name">Name</th>
               <th class="factoid-aliases">Aliases</th>
+              <th class="factoid-tags">Tags</th>
               <th class="factoid-text">Text</th>
             </tr>
-            {{range .}}
-              <tr>
-                <td class="factoid-name" id="factoid-{{.Name}}">{{.Name}}</td>
+            {{range .Factoids}}
+              <tr class="factoid" data-tags="{{range .Tags}} {{.}} {{end}}">
+                <td class="factoid-name" id="factoid-{{.Name}}">
+                  {{.Name}}
+                  {{if .Locked}}<span class="glyphicon glyphicon-lock" title="Locked{{if .Owner}}, owned by {{.Owner}}{{end}}"></span>{{end}}
+                </td>
                 <td class="factoid-aliases">
                   {{$aliaslen := .Aliases|len}}
                   {{if gt $aliaslen 0}}
@@ -135,84 +158,78 @@
                     </ul>
                   {{end}}
                 </td>
-                <td class="factoid-text">{{.Text | linkify | ircize}}</td>
+                <td class="factoid-tags">
+                  {{range .Tags}}
+                    <a class="label label-info" href="#tag-{{.}}" data-tag="{{.}}">{{.}}</a>
+                  {{end}}
+                </td>
+                <td class="factoid-text">{{.Text | linkify | ircize | linebreaks}}</td>
               </tr>
             {{end}}
           </table>
 
         </div>
       </div>
+      <div class="row proposals">
+        <div class="panel panel-default">
+          <div class="panel-heading">
+            <h2 id="proposals" class="panel-title">Proposals</h2>
+          </div>
+          {{if .Proposals}}
+            <table class="table table-striped">
+              <tr>
+                <th class="proposal-id">#</th>
+                <th class="proposal-name">Name</th>
+                <th class="proposal-user">Proposed by</th>
+                <th class="proposal-text">Text</th>
+                <th class="proposal-actions"></th>
+              </tr>
+              {{$approval := .Approval}}
+              {{$path := .ProposalPath}}
+              {{range .Proposals}}
+                <tr>
+                  <td class="proposal-id">{{.ID}}</td>
+                  <td class="proposal-name">{{.Key}}</td>
+                  <td class="proposal-user"><span title="{{.User}}">{{.Nick}}</span></td>
+                  <td class="proposal-text">{{.Text | linkify | ircize | linebreaks}}</td>
+                  <td class="proposal-actions">
+                    {{if $approval}}
+                      <form class="form-inline" method="post" action="{{$path}}">
+                        <input type="hidden" name="id" value="{{.ID}}">
+                        <input type="password" class="form-control input-sm" name="secret" placeholder="secret">
+                        <button type="submit" class="btn btn-xs btn-success" name="action" value="approve">Approve</button>
+                        <button type="submit" class="btn btn-xs btn-danger" name="action" value="reject">Reject</button>
+                      </form>
+                    {{else}}
+                      <span class="nobr">.approve {{.ID}}</span> / <span class="nobr">.reject {{.ID}}</span>
+                    {{end}}
+                  </td>
+                </tr>
+              {{end}}
+            </table>
+          {{else}}
+            <div class="panel-body">There are no pending proposals.</div>
+          {{end}}
+        </div>
+      </div>
       <div class="row">
         <div class="panel panel-default">
           <div class="panel-heading">
             <h2 id="command-help" class="panel-title">Command help</h2>
           </div>
           <table class="table">
-            <tr>
-              <th colspan="3">Administer factoids</th>
-            </tr>
-            <tr>
-              <td class="command-name">.add</td>
-              <td class="command-arguments"><span class="nobr">&lt;factoid-trigger&gt;</span> <span class="nobr">&lt;factoid-text&gt;</span></td>
-              <td class="command-description">The factoid-trigger will trigger the factoid, upon which fact the factoid-text will be printed.<br/>This command adds a new factoid.</td>
-            </tr>
-            <tr>
-              <td class="command-name">.mod</td>
-              <td class="command-arguments"><span class="nobr">&lt;factoid-trigger&gt;</span> <span class="nobr">&lt;factoid-text&gt;</span></td>
-              <td class="command-description">The factoid-trigger will trigger the factoid, upon which fact the factoid-text will be printed.<br/>This command modifies an existing factoid.</td>
-            </tr>
-            <tr>
-              <td class="command-name">.del</td>
-              <td class="command-arguments"><span class="nobr">&lt;factoid-trigger&gt;</span></td>
-              <td class="command-description">This command deletes an existing factoid with the given trigger and all of its aliases.</td>
-            </tr>
-            <tr>
-              <td class="command-name">.rename</td>
-              <td class="command-arguments"><span class="nobr">&lt;old-factoid-trigger&gt;</span> <span class="nobr">&lt;new-factoid-trigger&gt;</span></td>
-              <td class="command-description">This command renames an existing factoid to the new trigger, the new trigger must not exist beforehand. Also updates the aliases.</td>
-            </tr>
-
-            <tr>
-              <th colspan="3">Administer factoid aliases</th>
-            </tr>
-            <tr>
-              <td class="command-name">.addalias</td>
-              <td class="command-arguments"><span class="nobr">&lt;alias-trigger&gt;</span> <span class="nobr">&lt;factoid-trigger&gt;</span></td>
-              <td class="command-description">The alias-trigger will trigger the factoid-trigger.<br/>This command adds a new alias.</td>
-            </tr>
-            <tr>
-              <td class="command-name">.modalias</td>
-              <td class="command-arguments"><span class="nobr">&lt;alias-trigger&gt;</span> <span class="nobr">&lt;factoid-trigger&gt;</span></td>
-              <td class="command-description">The alias-trigger will trigger the factoid-trigger.<br/>This command modifies an existing alias.</td>
-            </tr>
-            <tr>
-              <td class="command-name">.delalias</td>
-              <td class="command-arguments"><span class="nobr">&lt;alias-trigger&gt;</span></td>
-              <td class="command-description">This command deletes an existing alias with the given trigger.</td>
-            </tr>
-
-            <tr>
-              <th colspan="3">Administer administrators</th>
-            </tr>
-            <tr>
-              <td class="command-name">.addadmin</td>
-              <td class="command-arguments"><span class="nobr">&lt;username&gt;</span></td>
-              <td class="command-description">Adds an administrator identified by the given registered freenode username (&quot;sztanpet&quot;)</td>
-            </tr>
-            <tr>
-              <td class="command-name">.deladmin</td>
-              <td class="command-arguments"><span class="nobr">&lt;username&gt;</span></td>
-              <td class="command-description">Deletes an administrator with the given username</td>
-            </tr>
-
-            <tr>
-              <th colspan="3">Raw irc protocol access</th>
-            </tr>
-            <tr>
-              <td class="command-name">.raw</td>
-              <td class="command-arguments"><span class="nobr">&lt;irc-protocol&gt;</span></td>
-              <td class="command-description">Send everything after the command as-is to the IRC server<br/>Example: &quot;.raw PRIVMSG #systemd :needs the colons so that space-separated things are not seen as arguments&quot;</td>
-            </tr>
+            {{range .Commands}}
+              <tr>
+                <th colspan="3">{{.Name}}</th>
+              </tr>
+              {{range .Commands}}
+                <tr>
+                  <td class="command-name">{{.}}</td>
+                  <td class="command-arguments">{{range .ArgList}}<span class="nobr">{{.}}</span> {{end}}</td>
+                  <td class="command-description">{{range $i, $line := .Lines}}{{if $i}}<br/>{{end}}{{$line}}{{end}}</td>
+                </tr>
+              {{end}}
+            {{end}}
           </table>
         </div>
       </div>
@@ -246,6 +263,25 @@
           }
         }).init();
 
+        var filter = function(tag) {
+          $(".tag-filter .btn").removeClass("btn-primary").addClass("btn-default");
+          $(".tag-filter .btn").filter(function() {
+            return $(this).data("tag") === tag;
+          }).removeClass("btn-default").addClass("btn-primary");
+
+          $("tr.factoid").each(function() {
+            var tags = $(this).attr("data-tags");
+            $(this).toggle(tag === "" || tags.indexOf(" " + tag + " ") !== -1);
+          });
+        };
+
+        $("[data-tag]").click(function() {
+          filter(String($(this).data("tag")));
+        });
+        if(window.location.hash.indexOf("#tag-") === 0) {
+          filter(window.location.hash.substr(5));
+        }
+
       }());
     </script>
   </body>
@@ -0,0 +1,162 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package web
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrusted parses the addresses and networks of the trusted proxies, like
+// "127.0.0.1" or "10.0.0.0/8"
+func ParseTrusted(addrs []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: addr}
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+	}
+
+	return ret, nil
+}
+
+func isTrusted(trusted []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstValue returns the first of the comma separated values of the header
+func firstValue(h http.Header, name string) string {
+	v := h.Get(name)
+	if pos := strings.IndexByte(v, ','); pos >= 0 {
+		v = v[:pos]
+	}
+	return strings.TrimSpace(v)
+}
+
+// Forwarded sets the scheme of the request url to the one the client used,
+// and if the request comes from a trusted proxy, takes the address of the
+// client, the scheme and the host from the X-Forwarded-* headers
+func Forwarded(trusted []*net.IPNet, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nr := new(http.Request)
+		*nr = *r
+		u := *r.URL
+		nr.URL = &u
+
+		nr.URL.Scheme = "http"
+		if r.TLS != nil {
+			nr.URL.Scheme = "https"
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !isTrusted(trusted, host) {
+			h.ServeHTTP(w, nr)
+			return
+		}
+
+		// every proxy appends the address it got the request from, the
+		// client is the rightmost one that is not a trusted proxy
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			addrs := strings.Split(fwd, ",")
+			client := strings.TrimSpace(addrs[0])
+			for i := len(addrs) - 1; i >= 0; i-- {
+				addr := strings.TrimSpace(addrs[i])
+				if !isTrusted(trusted, addr) {
+					client = addr
+					break
+				}
+			}
+			if net.ParseIP(client) != nil {
+				nr.RemoteAddr = client
+			}
+		}
+		switch proto := strings.ToLower(firstValue(r.Header, "X-Forwarded-Proto")); proto {
+		case "http", "https":
+			nr.URL.Scheme = proto
+		}
+		if fwdHost := firstValue(r.Header, "X-Forwarded-Host"); fwdHost != "" {
+			nr.Host = fwdHost
+		}
+
+		h.ServeHTTP(w, nr)
+	})
+}
+
+// RedirectHTTPS redirects the plain http requests to https on the port of
+// tlsAddr, serves the rest (that came through a proxy with https) and the
+// exempt paths with h, needs Forwarded to set the scheme
+// github does not follow redirects, so its hook has to stay exempt
+func RedirectHTTPS(tlsAddr string, h http.Handler, exempt ...string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	skip := make(map[string]bool, len(exempt))
+	for _, p := range exempt {
+		skip[clean(p)] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Scheme == "https" || skip[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if port != "" && port != "443" && port != "https" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		// the webhooks are POSTs, 301 would turn them into GETs
+		code := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, u.String(), code)
+	})
+}
@@ -0,0 +1,110 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package web
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sztanpet/sd-bot/debug"
+)
+
+// Certificate is a tls certificate that gets loaded again when its files
+// change, so that renewing it does not need a restart
+type Certificate struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // of the newer of the two files at the last load
+}
+
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// GetCertificate is for tls.Config.GetCertificate
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Reload loads the certificate again if one of its files changed since the
+// last load, returns whether it did, the old one stays in use on error
+func (c *Certificate) Reload() (bool, error) {
+	modTime, err := c.newest()
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	changed := c.cert == nil || !modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+	return true, nil
+}
+
+// Watch checks the files every interval, never returns
+func (c *Certificate) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := c.Reload()
+		if err != nil {
+			d.Error("Could not reload the certificate", "file", c.certFile, "err", err)
+		} else if reloaded {
+			d.P("Reloaded the certificate", c.certFile)
+		}
+	}
+}
+
+func (c *Certificate) newest() (time.Time, error) {
+	var ret time.Time
+	for _, p := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return ret, err
+		}
+		if fi.ModTime().After(ret) {
+			ret = fi.ModTime()
+		}
+	}
+
+	return ret, nil
+}
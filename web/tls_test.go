@@ -0,0 +1,99 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for name into the files
+func writeCert(t *testing.T, certPath, keyPath, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func commonName(t *testing.T, c *Certificate) string {
+	cert, _ := c.GetCertificate(nil)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := filepath.Join(dir, "crt"), filepath.Join(dir, "key")
+	writeCert(t, certPath, keyPath, "old")
+	c, err := LoadCertificate(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	if reloaded, err := c.Reload(); reloaded || err != nil {
+		t.Fatalf("unexpected reload without changes, err %v", err)
+	}
+
+	// a broken certificate keeps the old one
+	ioutil.WriteFile(certPath, []byte("garbage"), 0600)
+	os.Chtimes(certPath, time.Now(), time.Now().Add(time.Minute))
+	if _, err := c.Reload(); err == nil || commonName(t, c) != "old" {
+		t.Fatalf("expected an error and the old certificate, err %v", err)
+	}
+
+	writeCert(t, certPath, keyPath, "new")
+	os.Chtimes(certPath, time.Now(), time.Now().Add(2*time.Minute))
+	if reloaded, err := c.Reload(); !reloaded || err != nil || commonName(t, c) != "new" {
+		t.Fatalf("expected the new certificate, err %v", err)
+	}
+}
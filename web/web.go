@@ -0,0 +1,125 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package web routes the http requests of the bot, only the registered paths
+// are served, everything else is a 404
+// the public routes are served on the website address, the admin ones (the
+// metrics, the health checks, the audit log) on the admin address if the
+// config sets one, otherwise on the website address too
+// the website can be served with TLS, and behind reverse proxies
+package web
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Router serves the handlers registered for exact paths, and the handlers
+// registered for prefixes on every path below them, the longest prefix wins
+type Router struct {
+	mu       sync.RWMutex
+	exact    map[string]http.Handler
+	prefixes map[string]http.Handler
+}
+
+var (
+	// Public is served on the website address
+	Public = NewRouter()
+	// Admin is served on the admin address
+	Admin = NewRouter()
+)
+
+func NewRouter() *Router {
+	return &Router{
+		exact:    map[string]http.Handler{},
+		prefixes: map[string]http.Handler{},
+	}
+}
+
+// clean makes sure the path is absolute, the config has paths without the
+// leading slash
+func clean(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// Handle registers h for the path, panics if the path is registered already
+func (rt *Router) Handle(p string, h http.Handler) {
+	p = clean(p)
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if _, ok := rt.exact[p]; ok {
+		panic("web: route registered twice: " + p)
+	}
+	rt.exact[p] = h
+}
+
+func (rt *Router) HandleFunc(p string, f func(http.ResponseWriter, *http.Request)) {
+	rt.Handle(p, http.HandlerFunc(f))
+}
+
+// HandlePrefix registers h for every path starting with prefix, panics if the
+// prefix is registered already
+func (rt *Router) HandlePrefix(prefix string, h http.Handler) {
+	prefix = clean(prefix)
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if _, ok := rt.prefixes[prefix]; ok {
+		panic("web: prefix registered twice: " + prefix)
+	}
+	rt.prefixes[prefix] = h
+}
+
+func (rt *Router) lookup(p string) (http.Handler, bool) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	if h, ok := rt.exact[p]; ok {
+		return h, true
+	}
+
+	var ret http.Handler
+	var longest int
+	for prefix, h := range rt.prefixes {
+		if len(prefix) > longest && strings.HasPrefix(p, prefix) {
+			ret, longest = h, len(prefix)
+		}
+	}
+	return ret, ret != nil
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	Fallback(rt).ServeHTTP(w, r)
+}
+
+// Fallback serves the request with the first router that has a handler for
+// the path, or answers with 404
+func Fallback(routers ...*Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rt := range routers {
+			if h, ok := rt.lookup(r.URL.Path); ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+}
@@ -0,0 +1,155 @@
+/***
+  This file is part of sd-bot.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  sd-bot is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  sd-bot is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with sd-bot; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serve(h http.Handler, p string) (int, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+	return w.Code, w.Body.String()
+}
+
+func reply(s string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(s))
+	}
+}
+
+func TestRouter(t *testing.T) {
+	rt := NewRouter()
+	rt.HandleFunc("/", reply("page"))
+	rt.HandleFunc("hook", reply("hook"))
+	rt.HandlePrefix("/debug/", reply("debug"))
+	rt.HandlePrefix("/debug/pprof/", reply("pprof"))
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/", 200, "page"},
+		{"/hook", 200, "hook"},
+		{"/debug/vars", 200, "debug"},
+		{"/debug/pprof/heap", 200, "pprof"},
+		{"/hook/", 404, ""},
+		{"/favicon.ico", 404, ""},
+		{"/debug", 404, ""},
+	}
+	for _, tt := range tests {
+		code, body := serve(rt, tt.path)
+		if code != tt.code || (code == 200 && body != tt.body) {
+			t.Errorf("%s: expected %d %q, got %d %q", tt.path, tt.code, tt.body, code, body)
+		}
+	}
+}
+
+func TestFallback(t *testing.T) {
+	admin, public := NewRouter(), NewRouter()
+	admin.HandleFunc("/metrics", reply("metrics"))
+	public.HandleFunc("/", reply("page"))
+
+	h := Fallback(admin, public)
+	for p, want := range map[string]string{"/metrics": "metrics", "/": "page"} {
+		if code, body := serve(h, p); code != 200 || body != want {
+			t.Errorf("%s: expected %q, got %d %q", p, want, code, body)
+		}
+	}
+	if code, _ := serve(h, "/nope"); code != 404 {
+		t.Errorf("expected 404, got %d", code)
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+
+	rt := NewRouter()
+	rt.HandleFunc("/hook", reply("a"))
+	rt.HandleFunc("hook", reply("b"))
+}
+
+func TestForwarded(t *testing.T) {
+	trusted, err := ParseTrusted([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+	if _, err := ParseTrusted([]string{"not an ip"}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	var got *http.Request
+	h := Forwarded(trusted, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+
+	tests := []struct {
+		remote, fwd, proto, host         string
+		wantRemote, wantScheme, wantHost string
+	}{
+		// untrusted clients cannot spoof anything
+		{"1.2.3.4:5", "6.6.6.6", "https", "evil", "1.2.3.4:5", "http", "example.com"},
+		{"10.0.0.1:5", "1.2.3.4", "https", "sd-bot.example.org", "1.2.3.4", "https", "sd-bot.example.org"},
+		// the spoofed leftmost address is skipped
+		{"10.0.0.1:5", "6.6.6.6, 1.2.3.4, 192.168.1.1", "HTTPS", "", "1.2.3.4", "https", "example.com"},
+		{"192.168.1.1:5", "", "gopher", "", "192.168.1.1:5", "http", "example.com"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		r.Header.Set("X-Forwarded-For", tt.fwd)
+		r.Header.Set("X-Forwarded-Proto", tt.proto)
+		r.Header.Set("X-Forwarded-Host", tt.host)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		if got.RemoteAddr != tt.wantRemote || got.URL.Scheme != tt.wantScheme || got.Host != tt.wantHost {
+			t.Errorf("%s %q: unexpected %s %s %s", tt.remote, tt.fwd, got.RemoteAddr, got.URL.Scheme, got.Host)
+		}
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	h := Forwarded(nil, RedirectHTTPS(":8443", reply("page")))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.org:8080/proposals?id=1", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://example.org:8443/proposals?id=1" {
+		t.Fatalf("unexpected redirect %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/form", nil))
+	if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != "https://example.com:8443/form" {
+		t.Fatalf("unexpected redirect %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// the exempt paths are served over http too
+	h = Forwarded(nil, RedirectHTTPS(":8443", reply("hook"), "hook"))
+	if code, body := serve(h, "/hook"); code != 200 || body != "hook" {
+		t.Fatalf("unexpected response %d %q", code, body)
+	}
+}